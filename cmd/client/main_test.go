@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// serveKeys plays the server's part as key authority.
+func serveKeys(t *testing.T, ctx context.Context, conn *pubsub.Connection) *pubsub.KeyRegistry {
+	t.Helper()
+
+	keys, err := pubsub.OpenKeyFile(filepath.Join(t.TempDir(), routing.KeysFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		keys.Close()
+	})
+
+	if _, err = pubsub.Serve(
+		ctx,
+		conn,
+		pubsub.JSON,
+		routing.ExchangePerilDirect,
+		routing.KeyRegisterKey,
+		routing.KeyRegisterKey,
+		pubsub.DurableQueue,
+		func(reg pubsub.KeyRegistration) (routing.PublicKey, error) {
+			return routing.PublicKey{Username: reg.Identity, Key: reg.PublicKey}, keys.Register(reg)
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = pubsub.Serve(
+		ctx,
+		conn,
+		pubsub.JSON,
+		routing.ExchangePerilDirect,
+		routing.KeyLookupKey,
+		routing.KeyLookupKey,
+		pubsub.DurableQueue,
+		func(req routing.KeyRequest) (routing.PublicKey, error) {
+			key, err := keys.PublicKey(req.Username)
+			return routing.PublicKey{Username: req.Username, Key: key}, err
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+// startClient subscribes a player's move and war handlers the way main
+// does and returns their game state and signer.
+func startClient(
+	t *testing.T,
+	ctx context.Context,
+	conn *pubsub.Connection,
+	username string,
+) (*gamelogic.GameState, pubsub.Signer) {
+	t.Helper()
+
+	gs := gamelogic.NewGameState(username)
+	signingKey, err := pubsub.LoadEd25519Key(t.TempDir(), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := pubsub.NewEd25519Signer(username, signingKey)
+
+	keyClient := pubsub.NewRPCClient(conn, pubsub.JSON, 5*time.Second)
+	t.Cleanup(func() {
+		keyClient.Close()
+	})
+	if err = registerKey(ctx, keyClient, username, signingKey); err != nil {
+		t.Fatal(err)
+	}
+	keys := pubsub.NewResolvingKeyRegistry(lookupKey(ctx, keyClient))
+
+	outbox, err := pubsub.OpenOutbox(
+		filepath.Join(t.TempDir(), username+".outbox"),
+		pubsub.NewConfirmPublisher(conn, 5*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		outbox.Close()
+	})
+
+	if _, err = pubsub.SubscribeMessage(
+		ctx,
+		conn,
+		pubsub.JSON,
+		routing.ExchangePerilTopic,
+		fmt.Sprintf("%s.%s", routing.ArmyMovesPrefix, username),
+		fmt.Sprintf("%s.*", routing.ArmyMovesPrefix),
+		pubsub.TransientQueue,
+		handlerMove(gs, conn.Publisher(), signer),
+		pubsub.WithVerification(keys, moveClaims),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = pubsub.SubscribeMessage(
+		ctx,
+		conn,
+		pubsub.JSON,
+		routing.ExchangePerilTopic,
+		routing.WarRecognitionsQueue,
+		fmt.Sprintf("%s.*", routing.WarRecognitionsPrefix),
+		routing.WarQueue,
+		handlerWar(gs, outbox, signer),
+		pubsub.WithRetry(pubsub.RetryPolicy{
+			Delays:      []time.Duration{10 * time.Millisecond},
+			MaxAttempts: 10,
+		}),
+		pubsub.WithVerification(keys, warClaims),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	return gs, signer
+}
+
+func TestWarIsFoughtAndLogged(t *testing.T) {
+	broker := pubsub.NewMemoryBroker()
+	conn, err := pubsub.Connect(broker.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = pubsub.ApplyTopology(conn, routing.Topology); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authority := serveKeys(t, ctx, conn)
+
+	// The server only takes game logs signed by the player they are about.
+	gameLogs := make(chan pubsub.Message[routing.GameLog], 1)
+	if _, err = pubsub.SubscribeMessage(
+		ctx,
+		conn,
+		nil,
+		routing.ExchangePerilTopic,
+		routing.GameLogSlug,
+		fmt.Sprintf("%s.*", routing.GameLogSlug),
+		pubsub.DurableQueue,
+		func(msg pubsub.Message[routing.GameLog]) pubsub.AckType {
+			gameLogs <- msg
+			return pubsub.Ack
+		},
+		pubsub.WithVerification(
+			authority,
+			func(msg pubsub.Message[routing.GameLog]) []string {
+				return []string{routingKeyUsername(msg.RoutingKey), msg.Body.Username}
+			},
+		),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, aliceSigner := startClient(t, ctx, conn, "alice")
+	bob, _ := startClient(t, ctx, conn, "bob")
+
+	if err = bob.CommandSpawn([]string{"spawn", "europe", "artillery"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = alice.CommandSpawn([]string{"spawn", "asia", "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	move, err := alice.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pubsub.PublishJSON(
+		conn,
+		routing.ExchangePerilTopic,
+		fmt.Sprintf("%s.%s", routing.ArmyMovesPrefix, "alice"),
+		move,
+		pubsub.WithTimestamp(time.Now()),
+		pubsub.WithSignature(aliceSigner),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob sees the move and recognises the war, which only alice, the
+	// attacker, can fight. She loses it and logs the outcome.
+	var gameLog pubsub.Message[routing.GameLog]
+	select {
+	case gameLog = <-gameLogs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no game log was published")
+	}
+
+	want := "bob won a war against alice"
+	if gameLog.Body.Username != "alice" || gameLog.Body.Message != want {
+		t.Errorf("game log = %+v, want %q from alice", gameLog.Body, want)
+	}
+	if units := alice.GetPlayerSnap().Units; len(units) != 0 {
+		t.Errorf("alice still has %d units after losing the war", len(units))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const defaultDeadLetterLimit = 10
+
+func commandDLQ(conn *pubsub.Connection, words []string) error {
+	if len(words) < 2 {
+		return errors.New("usage: dlq <list|replay|purge> [n]")
+	}
+
+	limit := defaultDeadLetterLimit
+	if len(words) > 2 {
+		n, err := strconv.Atoi(words[2])
+		if err != nil {
+			return fmt.Errorf("error: %s is not a valid number", words[2])
+		}
+		limit = n
+	}
+
+	switch words[1] {
+	case "list":
+		letters, err := pubsub.ListDeadLetters(conn, limit)
+		if err != nil {
+			return err
+		}
+
+		if len(letters) == 0 {
+			fmt.Println("The dead-letter queue is empty.")
+			return nil
+		}
+
+		for _, letter := range letters {
+			printDeadLetter(letter)
+		}
+	case "replay":
+		n, err := pubsub.ReplayDeadLetters(conn, limit)
+		fmt.Printf("Replayed %d dead letter(s).\n", n)
+		if err != nil {
+			return err
+		}
+	case "purge":
+		n, err := pubsub.PurgeDeadLetters(conn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d dead letter(s).\n", n)
+	default:
+		return fmt.Errorf("unknown dlq command '%s'", words[1])
+	}
+
+	return nil
+}
+
+func printDeadLetter(letter pubsub.DeadLetter) {
+	fmt.Printf("* %s -> %s (%s)\n", letter.Exchange, letter.RoutingKey, letter.ContentType)
+	if letter.Error != "" {
+		fmt.Printf("    error: %s\n", letter.Error)
+	}
+	for _, death := range letter.Deaths {
+		fmt.Printf(
+			"    %s from %s %d time(s), last at %s\n",
+			death.Reason,
+			death.Queue,
+			death.Count,
+			death.Time.Format(time.RFC3339),
+		)
+	}
+
+	body := deadLetterBody(letter.RoutingKey)
+	if body == nil {
+		fmt.Printf("    %d byte(s) of unknown payload\n", len(letter.Body))
+		return
+	}
+
+	if err := letter.Decode(body); err != nil {
+		fmt.Printf("    could not decode payload: %s\n", err)
+		return
+	}
+	fmt.Printf("    %+v\n", body)
+}
+
+func deadLetterBody(routingKey string) any {
+	prefix, _, _ := strings.Cut(routingKey, ".")
+	switch prefix {
+	case routing.ArmyMovesPrefix:
+		return &gamelogic.ArmyMove{}
+	case routing.WarRecognitionsPrefix:
+		return &gamelogic.RecognitionOfWar{}
+	case routing.GameLogSlug:
+		return &routing.GameLog{}
+	case routing.PauseKey:
+		return &routing.PlayingState{}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const (
+	defaultReplayLimit = 100
+	// The stream never signals that it has caught up, so a replay stops
+	// once no game log has arrived for this long.
+	replayIdleTimeout = time.Second
+)
+
+// commandReplay prints the game logs from the game log stream starting at
+// an RFC 3339 time, or a duration ago.
+func commandReplay(conn *pubsub.Connection, words []string) error {
+	if len(words) < 2 {
+		return errors.New("usage: replay <time|duration> [n]")
+	}
+
+	since, err := parseReplayStart(words[1])
+	if err != nil {
+		return err
+	}
+
+	limit := defaultReplayLimit
+	if len(words) > 2 {
+		n, err := strconv.Atoi(words[2])
+		if err != nil {
+			return fmt.Errorf("error: %s is not a valid number", words[2])
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logs := make(chan routing.GameLog)
+	sub, err := pubsub.SubscribeByContentType(
+		ctx,
+		conn,
+		routing.ExchangePerilTopic,
+		routing.GameLogStreamQueue,
+		fmt.Sprintf("%s.*", routing.GameLogSlug),
+		routing.GameLogStream,
+		func(gl routing.GameLog) pubsub.AckType {
+			// The stream starts at the chunk holding since, which can
+			// begin with older logs.
+			if gl.CurrentTime.Before(since) {
+				return pubsub.Ack
+			}
+			select {
+			case logs <- gl:
+			case <-ctx.Done():
+			}
+			return pubsub.Ack
+		},
+		pubsub.WithStreamOffset(pubsub.StreamFromTime(since)),
+	)
+	if err != nil {
+		cancel()
+		return err
+	}
+	defer sub.Wait()
+	defer cancel()
+
+	n := 0
+loop:
+	for n < limit {
+		select {
+		case gl := <-logs:
+			fmt.Printf(
+				"%v %v: %v\n",
+				gl.CurrentTime.Format(time.RFC3339),
+				gl.Username,
+				gl.Message,
+			)
+			n++
+		case <-time.After(replayIdleTimeout):
+			break loop
+		}
+	}
+
+	fmt.Printf("Replayed %d game log(s).\n", n)
+	return nil
+}
+
+func parseReplayStart(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error: %s is neither a time nor a duration", s)
+	}
+
+	return t, nil
+}
@@ -2,4 +2,7 @@ module github.com/bootdotdev/learn-pub-sub-starter
 
 go 1.22.1
 
-require github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/rabbitmq/amqp091-go v1.10.0
+)
@@ -42,6 +42,12 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* dlq <list|replay|purge> [n]")
+	fmt.Println("    example:")
+	fmt.Println("    dlq list 5")
+	fmt.Println("* replay <time|duration> [n]")
+	fmt.Println("    example:")
+	fmt.Println("    replay 15m 20")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
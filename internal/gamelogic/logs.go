@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
@@ -14,7 +15,13 @@ const logsFile = "game.log"
 const writeToDiskSleep = 1 * time.Second
 
 func WriteLog(gamelog routing.GameLog) error {
-	log.Printf("received game log...")
+	return WriteLogs([]routing.GameLog{gamelog})
+}
+
+// WriteLogs appends all of gamelogs to the logs file in a single write and
+// syncs it to disk once.
+func WriteLogs(gamelogs []routing.GameLog) error {
+	log.Printf("received %d game log(s)...", len(gamelogs))
 	time.Sleep(writeToDiskSleep)
 
 	f, err := os.OpenFile(logsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -23,10 +30,15 @@ func WriteLog(gamelog routing.GameLog) error {
 	}
 	defer f.Close()
 
-	str := fmt.Sprintf("%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
-	_, err = f.WriteString(str)
-	if err != nil {
+	var sb strings.Builder
+	for _, gamelog := range gamelogs {
+		fmt.Fprintf(&sb, "%v %v: %v\n", gamelog.CurrentTime.Format(time.RFC3339), gamelog.Username, gamelog.Message)
+	}
+	if _, err = f.WriteString(sb.String()); err != nil {
 		return fmt.Errorf("could not write to logs file: %v", err)
 	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("could not sync logs file: %v", err)
+	}
 	return nil
 }
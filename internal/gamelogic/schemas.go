@@ -0,0 +1,16 @@
+package gamelogic
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// Wire versions of the messages defined in this package. Both carry full
+// Player snapshots, so a change to Player or Unit bumps both. Register an
+// upcaster from the old shape alongside every bump.
+const (
+	ArmyMoveVersion         = 1
+	RecognitionOfWarVersion = 1
+)
+
+func init() {
+	pubsub.SetSchemaVersion[ArmyMove](ArmyMoveVersion)
+	pubsub.SetSchemaVersion[RecognitionOfWar](RecognitionOfWarVersion)
+}
@@ -0,0 +1,217 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultBatchSize   = 100
+	defaultBatchWindow = time.Second
+)
+
+// BatchHandler handles a batch of messages. It returns either one AckType
+// per message, in order, or a single AckType that settles the whole batch
+// with one multiple=true ack or nack.
+type BatchHandler[T any] func([]Message[T]) []AckType
+
+// SettleAll settles every message of a batch with ackType.
+func SettleAll(ackType AckType) []AckType {
+	return []AckType{ackType}
+}
+
+// WithBatchSize caps how many messages SubscribeBatch hands the handler at
+// once.
+func WithBatchSize(size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.batchSize = size
+	}
+}
+
+// WithBatchWindow sets how long SubscribeBatch waits after the first
+// message of a batch for the batch to fill up before handing it over.
+func WithBatchWindow(window time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.batchWindow = window
+	}
+}
+
+func (o subscribeOptions) batchLimits() (int, time.Duration) {
+	size, window := o.batchSize, o.batchWindow
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if window <= 0 {
+		window = defaultBatchWindow
+	}
+
+	return size, window
+}
+
+// SubscribeBatch consumes queueName and hands the handler up to the batch
+// size of messages at a time, or whatever arrived within the batch window.
+// If codec is nil each delivery is decoded with the codec registered for
+// its ContentType. Batches are handled one at a time, so WithConcurrency
+// does not apply.
+func SubscribeBatch[T any](
+	ctx context.Context,
+	conn *Connection,
+	codec Codec,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	handler BatchHandler[T],
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	options, typed := newSubscribeOptions(opts)
+	if len(typed.middlewares) > 0 {
+		return nil, errors.New("batch subscriptions take batch middlewares through ChainBatch")
+	}
+	if options.prefetch == 0 {
+		size, _ := options.batchLimits()
+		options.prefetch = max(defaultPrefetch, size)
+	}
+
+	decode := verifying(decoder[T](codec), options.keys, typed.claimed)
+
+	return startConsumer(
+		ctx,
+		conn,
+		exchange,
+		queueName,
+		key,
+		queueKind,
+		options,
+		func(c *consumer, deliveryCh <-chan amqp.Delivery) {
+			consumeBatches(c, deliveryCh, handler, decode)
+		},
+	)
+}
+
+func consumeBatches[T any](
+	c *consumer,
+	deliveryCh <-chan amqp.Delivery,
+	handler BatchHandler[T],
+	decode func(amqp.Delivery) (T, error),
+) {
+	size, window := c.options.batchLimits()
+	deliveries := make([]amqp.Delivery, 0, size)
+	messages := make([]Message[T], 0, size)
+
+	timer := time.NewTimer(window)
+	stopTimer(timer)
+	defer timer.Stop()
+
+	flush := func() {
+		stopTimer(timer)
+		if len(deliveries) == 0 {
+			return
+		}
+
+		span := startBatchSpan(c.queueName, deliveries)
+		for i := range messages {
+			messages[i].Trace = span.Context
+		}
+
+		var ackTypes []AckType
+		c.timed(len(messages), func() {
+			ackTypes = handler(messages)
+		})
+		c.settleBatch(deliveries, ackTypes)
+		span.finish(nil)
+		deliveries = make([]amqp.Delivery, 0, size)
+		messages = make([]Message[T], 0, size)
+	}
+
+	for {
+		select {
+		case delivery, ok := <-deliveryCh:
+			if !ok {
+				flush()
+				return
+			}
+
+			c.received(delivery)
+			body, err := decode(delivery)
+			if err != nil {
+				c.decodeFailed(delivery, err)
+				continue
+			}
+
+			if len(deliveries) == 0 {
+				timer.Reset(window)
+			}
+			deliveries = append(deliveries, delivery)
+			messages = append(messages, newMessage(delivery, body))
+			if len(deliveries) >= size {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// stopTimer stops timer and drains a tick that already fired, so a later
+// Reset does not flush the next batch straight away.
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+func (c *consumer) settleBatch(deliveries []amqp.Delivery, ackTypes []AckType) {
+	if len(ackTypes) == 1 {
+		// Deliveries that failed to decode were settled when they arrived,
+		// so a multiple=true ack on the last one covers exactly this batch.
+		last := deliveries[len(deliveries)-1]
+
+		var err error
+		switch ackTypes[0] {
+		case Ack:
+			err = last.Ack(true)
+		case NackRequeue:
+			err = last.Nack(true, true)
+		case NackDiscard:
+			err = last.Nack(true, false)
+		default:
+			// RetryLater republishes every message on its own. settle
+			// counts each delivery, so they are not counted again below.
+			for _, delivery := range deliveries {
+				c.settle(delivery, ackTypes[0])
+			}
+			return
+		}
+
+		if err != nil {
+			log.Println(err)
+		}
+		for _, delivery := range deliveries {
+			c.stats.settled(c.queueName, delivery, ackTypes[0])
+		}
+		if c.options.stream != nil {
+			c.options.stream.advance(last)
+		}
+		return
+	}
+
+	if len(ackTypes) != len(deliveries) {
+		log.Printf(
+			"batch handler returned %d ack types for %d messages, requeueing the batch",
+			len(ackTypes),
+			len(deliveries),
+		)
+		c.settleBatch(deliveries, SettleAll(NackRequeue))
+		return
+	}
+
+	for i, delivery := range deliveries {
+		c.settle(delivery, ackTypes[i])
+	}
+}
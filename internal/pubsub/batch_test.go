@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchHandlerPanicDeadLettersTheBatch(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := make(chan int, 10)
+	if _, err := SubscribeBatch(
+		ctx,
+		conn,
+		nil,
+		testExchange,
+		"logs",
+		"logs",
+		TransientQueue,
+		ChainBatch(
+			func(msgs []Message[string]) []AckType {
+				calls <- len(msgs)
+				panic("disk on fire")
+			},
+			RecoverBatch[string](),
+		),
+		WithBatchSize(2),
+		WithBatchWindow(50*time.Millisecond),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"a", "b"} {
+		if err := PublishJSON(conn, testExchange, "logs", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := receive(t, calls); n != 2 {
+		t.Fatalf("batch of %d messages, want 2", n)
+	}
+
+	// Without a retry policy RetryLater dead-letters straight away.
+	eventually(t, func() bool {
+		letters, err := ListDeadLetters(conn, 10)
+		return err == nil && len(letters) == 2
+	})
+
+	// Each message of the batch is counted once.
+	var out strings.Builder
+	if _, err := conn.Metrics().WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `pubsub_retried_total{queue="logs",exchange="test_topic",routing_key="logs"} 2`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("metrics do not contain %s:\n%s", want, out.String())
+	}
+}
+
+func TestBatchAckType(t *testing.T) {
+	tests := []struct {
+		name     string
+		ackTypes []AckType
+		want     []AckType
+	}{
+		{"settle all", SettleAll(Ack), []AckType{Ack, Ack, Ack}},
+		{"per message", []AckType{Ack, NackDiscard, RetryLater}, []AckType{Ack, NackDiscard, RetryLater}},
+		{"mismatch", []AckType{Ack, Ack}, []AckType{NackRequeue, NackRequeue, NackRequeue}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := batchAckType(tt.ackTypes, len(tt.want), i); got != want {
+					t.Errorf("message %d: got %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec turns values into message bodies and back. Its content type is
+// stamped on every publish and used to pick a codec when subscribing by
+// content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON Codec = jsonCodec{}
+	Gob  Codec = gobCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSON.ContentType(): JSON,
+		Gob.ContentType():  Gob,
+	}
+)
+
+// RegisterCodec makes codec available to LookupCodec and to
+// SubscribeByContentType, replacing any codec with the same content type.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+func LookupCodec(contentType string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type '%s'", contentType)
+	}
+
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/gob"
+}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses message bodies. Its encoding is stamped as the
+// ContentEncoding of every body it compresses and used to pick it again
+// when decoding.
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// DefaultCompressionThreshold is the body size below which compressing
+// usually costs more than it saves.
+const DefaultCompressionThreshold = 1024
+
+// MaxDecompressedSize caps what the built-in compressors inflate a body
+// to, so a small compressed message cannot exhaust the consumer's memory.
+const MaxDecompressedSize = 16 << 20
+
+var ErrBodyTooLarge = errors.New("pubsub: decompressed body is too large")
+
+var (
+	Gzip Compressor = gzipCompressor{}
+	Zstd Compressor = zstdCompressor{}
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		Gzip.Encoding(): Gzip,
+		Zstd.Encoding(): Zstd,
+	}
+)
+
+// RegisterCompressor makes compressor available for decoding bodies with
+// its encoding, replacing any compressor with the same encoding.
+func RegisterCompressor(compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	compressors[compressor.Encoding()] = compressor
+}
+
+func LookupCompressor(encoding string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	compressor, ok := compressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+
+	return compressor, nil
+}
+
+// WithCompression compresses the body with compressor if it is at least
+// threshold bytes long. Subscribers decompress it transparently.
+func WithCompression(compressor Compressor, threshold int) PublishOption {
+	return func(p *publishOptions) {
+		if p.ContentEncoding != "" || len(p.Body) < threshold {
+			return
+		}
+
+		body, err := compressor.Compress(p.Body)
+		if err != nil {
+			log.Printf("could not compress message, sending it as is: %s", err)
+			return
+		}
+
+		p.Body = body
+		p.ContentEncoding = compressor.Encoding()
+	}
+}
+
+// decompress undoes the content encoding of a body.
+func decompress(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+
+	compressor, err := LookupCompressor(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressor.Decompress(body)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxDecompressedSize {
+		return nil, fmt.Errorf("%w: over %d bytes", ErrBodyTooLarge, MaxDecompressedSize)
+	}
+
+	return body, nil
+}
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, so one of each is shared.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(
+			nil,
+			zstd.WithDecoderMaxMemory(MaxDecompressedSize),
+			zstd.WithDecoderMaxWindow(MaxDecompressedSize),
+		)
+	})
+)
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Encoding() string {
+	return "zstd"
+}
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	enc, err := zstdEncoder()
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.EncodeAll(data, nil), nil
+}
+
+func (zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	dec, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := dec.DecodeAll(data, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) ||
+		errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w: over %d bytes", ErrBodyTooLarge, MaxDecompressedSize)
+	}
+
+	return body, err
+}
@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressorsRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("spam "), 1000)
+
+	for _, compressor := range []Compressor{Gzip, Zstd} {
+		t.Run(compressor.Encoding(), func(t *testing.T) {
+			compressed, err := compressor.Compress(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(body) {
+				t.Errorf("compressed %d bytes into %d", len(body), len(compressed))
+			}
+
+			got, err := decompress(compressor.Encoding(), compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Error("decompressed body differs from the original")
+			}
+		})
+	}
+}
+
+func TestDecompressRejectsOversizedBodies(t *testing.T) {
+	for _, size := range []int{MaxDecompressedSize, MaxDecompressedSize + 1} {
+		body := make([]byte, size)
+
+		for _, compressor := range []Compressor{Gzip, Zstd} {
+			compressed, err := compressor.Compress(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = compressor.Decompress(compressed)
+			if size > MaxDecompressedSize && !errors.Is(err, ErrBodyTooLarge) {
+				t.Errorf(
+					"%s: %d bytes: got %v, want %v",
+					compressor.Encoding(),
+					size,
+					err,
+					ErrBodyTooLarge,
+				)
+			}
+			if size <= MaxDecompressedSize && err != nil {
+				t.Errorf("%s: %d bytes: %v", compressor.Encoding(), size, err)
+			}
+		}
+	}
+}
+
+func TestDecompressUnknownEncoding(t *testing.T) {
+	if _, err := decompress("br", []byte("body")); err == nil {
+		t.Error("decompressed a body with an unsupported encoding")
+	}
+}
@@ -0,0 +1,311 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrPublishNacked        = errors.New("pubsub: publish was nacked by the broker")
+	ErrConfirmTimeout       = errors.New("pubsub: timed out waiting for publish confirmation")
+	ErrConfirmChannelClosed = errors.New("pubsub: channel closed before publish was confirmed")
+	ErrUnroutable           = errors.New("pubsub: publish was returned because no queue took it")
+)
+
+// Confirmation is the pending broker acknowledgement of a single publish.
+type Confirmation struct {
+	done      chan struct{}
+	err       error
+	mandatory bool
+}
+
+func newConfirmation(mandatory bool) *Confirmation {
+	return &Confirmation{
+		done:      make(chan struct{}),
+		mandatory: mandatory,
+	}
+}
+
+func (c *Confirmation) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Done is closed once the broker has acked or nacked the publish.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports the outcome of the publish. It is only meaningful once Done
+// is closed.
+func (c *Confirmation) Err() error {
+	return c.err
+}
+
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrConfirmTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// ConfirmPublisher publishes on a channel in confirm mode and correlates
+// the broker's acks and nacks with each publish by delivery tag.
+type ConfirmPublisher struct {
+	conn    *Connection
+	timeout time.Duration
+
+	mu      sync.Mutex
+	ch      Channel
+	pending map[uint64]*Confirmation
+
+	// mandatoryMu keeps a single mandatory publish in flight, so a
+	// returned message always belongs to the one being waited for.
+	mandatoryMu sync.Mutex
+}
+
+func NewConfirmPublisher(conn *Connection, timeout time.Duration) *ConfirmPublisher {
+	return &ConfirmPublisher{
+		conn:    conn,
+		timeout: timeout,
+	}
+}
+
+// Publish sends msg and returns immediately with a Confirmation that
+// resolves when the broker confirms it.
+func (p *ConfirmPublisher) Publish(
+	ctx context.Context,
+	exchange, key string,
+	msg amqp.Publishing,
+) (*Confirmation, error) {
+	return p.publish(ctx, exchange, key, false, msg)
+}
+
+func (p *ConfirmPublisher) publish(
+	ctx context.Context,
+	exchange, key string,
+	mandatory bool,
+	msg amqp.Publishing,
+) (*Confirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		if err := p.openChannel(); err != nil {
+			return nil, err
+		}
+	}
+
+	seq := p.ch.GetNextPublishSeqNo()
+	conf := newConfirmation(mandatory)
+	p.pending[seq] = conf
+
+	span := startProducerSpan(exchange, key, &msg)
+	err := p.ch.PublishWithContext(ctx, exchange, key, mandatory, false, msg)
+	span.finish(err)
+	p.conn.stats.publish(exchange, key, err)
+	if err != nil {
+		delete(p.pending, seq)
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// PublishAndWait sends msg and blocks until the broker confirms it or the
+// publisher's timeout elapses.
+func (p *ConfirmPublisher) PublishAndWait(
+	ctx context.Context,
+	exchange, key string,
+	msg amqp.Publishing,
+) error {
+	conf, err := p.Publish(ctx, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+
+	return p.wait(ctx, conf)
+}
+
+// PublishMandatory sends msg with the mandatory flag and blocks until the
+// broker confirms it. It fails with ErrUnroutable if no queue took msg.
+func (p *ConfirmPublisher) PublishMandatory(
+	ctx context.Context,
+	exchange, key string,
+	msg amqp.Publishing,
+) error {
+	p.mandatoryMu.Lock()
+	defer p.mandatoryMu.Unlock()
+
+	conf, err := p.publish(ctx, exchange, key, true, msg)
+	if err != nil {
+		return err
+	}
+
+	return p.wait(ctx, conf)
+}
+
+func (p *ConfirmPublisher) wait(ctx context.Context, conf *Confirmation) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	return conf.Wait(ctx)
+}
+
+func (p *ConfirmPublisher) openChannel() error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+
+	pending := map[uint64]*Confirmation{}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go p.listen(confirms, returns, pending)
+
+	p.ch = ch
+	p.pending = pending
+
+	return nil
+}
+
+// listen resolves pending confirmations. The broker sends a returned
+// message before the ack for it, so a return is already buffered by the
+// time the mandatory publish it belongs to is acked.
+func (p *ConfirmPublisher) listen(
+	confirms <-chan amqp.Confirmation,
+	returns <-chan amqp.Return,
+	pending map[uint64]*Confirmation,
+) {
+	for confirm := range confirms {
+		p.mu.Lock()
+		conf, ok := pending[confirm.DeliveryTag]
+		delete(pending, confirm.DeliveryTag)
+		p.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		returned := false
+		if conf.mandatory {
+			select {
+			case _, returned = <-returns:
+			default:
+			}
+		}
+
+		switch {
+		case !confirm.Ack:
+			conf.resolve(ErrPublishNacked)
+		case returned:
+			conf.resolve(ErrUnroutable)
+		default:
+			conf.resolve(nil)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for seq, conf := range pending {
+		conf.resolve(ErrConfirmChannelClosed)
+		delete(pending, seq)
+	}
+}
+
+func (p *ConfirmPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil {
+		return nil
+	}
+
+	return p.ch.Close()
+}
+
+func PublishJSONConfirmed[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	return PublishConfirmed(ctx, p, JSON, exchange, key, val, opts...)
+}
+
+func PublishGobConfirmed[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	return PublishConfirmed(ctx, p, Gob, exchange, key, val, opts...)
+}
+
+func PublishConfirmed[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	codec Codec,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	msg, err := marshal(codec, key, val, opts)
+	if err != nil {
+		return err
+	}
+
+	return p.PublishAndWait(ctx, exchange, key, msg)
+}
+
+func PublishJSONAsync[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) (*Confirmation, error) {
+	return PublishAsync(ctx, p, JSON, exchange, key, val, opts...)
+}
+
+func PublishGobAsync[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) (*Confirmation, error) {
+	return PublishAsync(ctx, p, Gob, exchange, key, val, opts...)
+}
+
+func PublishAsync[T any](
+	ctx context.Context,
+	p *ConfirmPublisher,
+	codec Codec,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) (*Confirmation, error) {
+	msg, err := marshal(codec, key, val, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Publish(ctx, exchange, key, msg)
+}
@@ -0,0 +1,65 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConfirmPublisherReportsAcksAndNacks(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	// The queue takes one message and refuses the rest, which the broker
+	// nacks.
+	declareTestQueue(t, conn, "bounded", "bounded", QueueOptions{
+		Durable:   true,
+		MaxLength: 1,
+		Overflow:  OverflowRejectPublish,
+	})
+
+	p := NewConfirmPublisher(conn, 5*time.Second)
+	defer p.Close()
+
+	ctx := context.Background()
+	if err := PublishJSONConfirmed(ctx, p, testExchange, "bounded", "first"); err != nil {
+		t.Fatalf("first publish: %v", err)
+	}
+
+	conf, err := PublishJSONAsync(ctx, p, testExchange, "bounded", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, conf.Done())
+	if !errors.Is(conf.Err(), ErrPublishNacked) {
+		t.Errorf("second publish: got %v, want %v", conf.Err(), ErrPublishNacked)
+	}
+
+	if got := broker.QueueLength("bounded"); got != 1 {
+		t.Errorf("queue has %d messages, want 1", got)
+	}
+}
+
+func TestConfirmPublisherReopensItsChannel(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+	declareTestQueue(t, conn, "confirmed", "confirmed", DurableQueue)
+
+	p := NewConfirmPublisher(conn, 5*time.Second)
+	defer p.Close()
+
+	ctx := context.Background()
+	if err := PublishJSONConfirmed(ctx, p, testExchange, "confirmed", "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Restart()
+	eventually(t, func() bool {
+		return PublishJSONConfirmed(ctx, p, testExchange, "confirmed", "after") == nil
+	})
+
+	if got := broker.QueueLength("confirmed"); got != 2 {
+		t.Errorf("queue has %d messages, want 2", got)
+	}
+}
@@ -0,0 +1,260 @@
+package pubsub
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+
+	defaultConfirmTimeout = 5 * time.Second
+)
+
+var (
+	ErrReconnecting     = errors.New("pubsub: connection is reconnecting")
+	ErrConnectionClosed = errors.New("pubsub: connection is closed")
+)
+
+// Connection wraps a Transport and transparently re-dials the
+// broker when it goes away, re-declaring and re-consuming every
+// subscription registered through it.
+type Connection struct {
+	dial Dialer
+
+	mu     sync.RWMutex
+	conn   Transport
+	subs   []*Subscription
+	closed bool
+	done   chan struct{}
+
+	publisher *Publisher
+	// confirmPublisher republishes deliveries for consumers, which only
+	// settle them once the broker has confirmed the copy.
+	confirmPublisher *ConfirmPublisher
+	metrics          *Metrics
+	stats            *connMetrics
+	options          connectOptions
+}
+
+type ConnectOption func(*connectOptions)
+
+type connectOptions struct {
+	planOnly bool
+}
+
+// PlanOnly connects without declaring the dead-letter exchange and queue,
+// so PlanTopology can report them without the connection creating them.
+func PlanOnly() ConnectOption {
+	return func(o *connectOptions) {
+		o.planOnly = true
+	}
+}
+
+// Dial connects to the RabbitMQ broker at url.
+func Dial(url string, opts ...ConnectOption) (*Connection, error) {
+	return Connect(AMQPDialer(url), opts...)
+}
+
+// Connect opens a Connection on the transports returned by dial.
+func Connect(dial Dialer, opts ...ConnectOption) (*Connection, error) {
+	options := connectOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if !options.planOnly {
+		if err = declareDeadLetterTopology(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c := &Connection{
+		dial:    dial,
+		conn:    conn,
+		done:    make(chan struct{}),
+		options: options,
+	}
+	c.metrics = NewMetrics()
+	c.stats = newConnMetrics(c.metrics)
+	c.publisher = NewPublisher(c, defaultPublisherChannels)
+	c.confirmPublisher = NewConfirmPublisher(c, defaultConfirmTimeout)
+	go c.watch(conn)
+
+	return c, nil
+}
+
+// Channel opens a new channel on the current broker connection. It
+// returns ErrReconnecting while the connection is being re-established.
+func (c *Connection) Channel() (Channel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return nil, ErrConnectionClosed
+	}
+	if c.conn == nil {
+		return nil, ErrReconnecting
+	}
+
+	return c.conn.Channel()
+}
+
+// Metrics returns the metrics the connection records about everything
+// published and consumed through it.
+func (c *Connection) Metrics() *Metrics {
+	return c.metrics
+}
+
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+// register runs the subscription's setup against the current connection
+// and remembers it so it can be replayed after every reconnect.
+func (c *Connection) register(sub *Subscription) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrConnectionClosed
+	}
+	if c.conn == nil {
+		return ErrReconnecting
+	}
+
+	if err := sub.setup(c.conn); err != nil {
+		return err
+	}
+	c.subs = append(c.subs, sub)
+
+	return nil
+}
+
+func (c *Connection) unregister(sub *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subs = slices.DeleteFunc(c.subs, func(s *Subscription) bool {
+		return s == sub
+	})
+}
+
+// Publisher returns the connection's shared publisher, which the
+// package-level publish functions use.
+func (c *Connection) Publisher() *Publisher {
+	return c.publisher
+}
+
+func (c *Connection) watch(conn Transport) {
+	closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	select {
+	case <-c.done:
+		return
+	case amqpErr := <-closeCh:
+		log.Printf("connection to broker lost: %v", amqpErr)
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	c.mu.Unlock()
+
+	c.reconnect()
+}
+
+func (c *Connection) reconnect() {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+
+		conn, err := c.dial()
+		if err != nil {
+			log.Printf("could not reconnect to broker: %s", err)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		subs := slices.Clone(c.subs)
+		c.mu.Unlock()
+
+		if !c.options.planOnly {
+			if err = declareDeadLetterTopology(conn); err != nil {
+				log.Printf("could not declare dead-letter topology: %s", err)
+				conn.Close()
+				continue
+			}
+		}
+
+		if err = resubscribe(conn, subs); err != nil {
+			log.Printf("could not restore subscriptions: %s", err)
+			conn.Close()
+			continue
+		}
+
+		// Close may have run while the subscriptions were being restored.
+		// Closing conn also stops the consumers that were just started.
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		c.mu.Unlock()
+
+		log.Println("reconnected to broker")
+		go c.watch(conn)
+
+		return
+	}
+}
+
+func resubscribe(conn Transport, subs []*Subscription) error {
+	for _, sub := range subs {
+		if err := sub.setup(conn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestConnectionResubscribesAfterRestart(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan Message[string], 1)
+	subscribeTestQueue(t, conn, "moves", func(msg Message[string]) AckType {
+		received <- msg
+		return Ack
+	})
+
+	if err := PublishJSON(conn, testExchange, "moves", "before"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, received)
+
+	broker.Restart()
+
+	// Publishes fail with ErrReconnecting until the connection is back,
+	// then reach the restored subscription.
+	reconnecting := false
+	eventually(t, func() bool {
+		err := PublishJSON(conn, testExchange, "moves", "after")
+		if errors.Is(err, ErrReconnecting) {
+			reconnecting = true
+		}
+		return err == nil
+	})
+	if !reconnecting {
+		t.Error("no publish failed with ErrReconnecting during the restart")
+	}
+	if msg := receive(t, received); msg.Body != "after" {
+		t.Errorf("got %q after the restart", msg.Body)
+	}
+
+	conn.Close()
+	if _, err := conn.Channel(); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Channel after Close = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestConnectionRetriesFailedDials(t *testing.T) {
+	broker := NewMemoryBroker()
+
+	var mu sync.Mutex
+	dials := 0
+	conn, err := Connect(func() (Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		dials++
+		if dials == 2 {
+			return nil, errors.New("broker is still starting")
+		}
+		return broker.Dial()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	broker.Restart()
+
+	eventually(t, func() bool {
+		ch, err := conn.Channel()
+		if err != nil {
+			return false
+		}
+		ch.Close()
+		return true
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if dials != 3 {
+		t.Errorf("dialed %d times, want the first dial, a failed one and a retry", dials)
+	}
+}
@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DeadLetterExchange = "peril_dlx"
+	DeadLetterQueue    = "peril_dlq"
+)
+
+// XDeath is one entry of the x-death header RabbitMQ adds every time a
+// message is dead-lettered.
+type XDeath struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// DeadLetter is a message sitting in the dead-letter queue together with
+// where it was originally published.
+type DeadLetter struct {
+	Exchange        string
+	RoutingKey      string
+	ContentType     string
+	ContentEncoding string
+	Body            []byte
+	Error           string
+	Deaths          []XDeath
+
+	delivery amqp.Delivery
+}
+
+// Decode decompresses the dead letter's body and unmarshals it into v with
+// the codec registered for its content type.
+func (d DeadLetter) Decode(v any) error {
+	codec, err := LookupCodec(d.ContentType)
+	if err != nil {
+		return err
+	}
+
+	data, err := decompress(d.ContentEncoding, d.Body)
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(data, v)
+}
+
+// DeadLetterTopology is the fanout exchange every queue dead-letters into
+// and the queue collecting everything behind it. Every Connection declares
+// it, and PlanTopology and ApplyTopology include it.
+var DeadLetterTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: DeadLetterExchange, Kind: amqp.ExchangeFanout, Durable: true},
+	},
+	Queues: []QueueSpec{
+		{Name: DeadLetterQueue, Kind: DurableQueue},
+	},
+	Bindings: []BindingSpec{
+		{Exchange: DeadLetterExchange, Queue: DeadLetterQueue},
+	},
+}
+
+func declareDeadLetterTopology(conn Transport) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return applyTopology(ch, DeadLetterTopology)
+}
+
+// ListDeadLetters returns up to limit messages from the dead-letter queue
+// without removing them from it.
+func ListDeadLetters(conn *Connection, limit int) ([]DeadLetter, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	letters, err := getDeadLetters(ch, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(letters) > 0 {
+		last := letters[len(letters)-1].delivery
+		if err = last.Nack(true, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return letters, nil
+}
+
+// ReplayDeadLetters republishes up to limit dead letters to the exchange
+// and routing key they were originally published to and removes them from
+// the dead-letter queue. It returns how many were replayed.
+func ReplayDeadLetters(conn *Connection, limit int) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	letters, err := getDeadLetters(ch, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, letter := range letters {
+		d := letter.delivery
+		msg := republishing(d)
+		for _, header := range []string{
+			originalExchangeHeader,
+			originalKeyHeader,
+			retryAttemptsHeader,
+			errorHeader,
+		} {
+			delete(msg.Headers, header)
+		}
+
+		if err = ch.PublishWithContext(
+			context.Background(),
+			letter.Exchange,
+			letter.RoutingKey,
+			false,
+			false,
+			msg,
+		); err != nil {
+			return i, err
+		}
+
+		if err = d.Ack(false); err != nil {
+			return i, err
+		}
+	}
+
+	return len(letters), nil
+}
+
+// PurgeDeadLetters drops every message in the dead-letter queue and
+// returns how many were removed.
+func PurgeDeadLetters(conn *Connection) (int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	return ch.QueuePurge(DeadLetterQueue, false)
+}
+
+func getDeadLetters(ch Channel, limit int) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	for len(letters) < limit {
+		d, ok, err := ch.Get(DeadLetterQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		letters = append(letters, newDeadLetter(d))
+	}
+
+	return letters, nil
+}
+
+func newDeadLetter(d amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		Body:            d.Body,
+		Deaths:          parseXDeath(d.Headers),
+		delivery:        d,
+	}
+	letter.Error, _ = d.Headers[errorHeader].(string)
+
+	// Messages that went through retry queues were dead-lettered from
+	// there, so the first death no longer points at the original exchange.
+	if exchange, ok := d.Headers[originalExchangeHeader].(string); ok {
+		letter.Exchange = exchange
+		letter.RoutingKey, _ = d.Headers[originalKeyHeader].(string)
+	} else if exchange, ok := d.Headers["x-first-death-exchange"].(string); ok {
+		letter.Exchange = exchange
+	} else if len(letter.Deaths) > 0 {
+		letter.Exchange = letter.Deaths[len(letter.Deaths)-1].Exchange
+	}
+
+	return letter
+}
+
+func parseXDeath(headers amqp.Table) []XDeath {
+	entries, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	deaths := []XDeath{}
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		death := XDeath{}
+		death.Queue, _ = table["queue"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Count, _ = table["count"].(int64)
+		death.Time, _ = table["time"].(time.Time)
+		if keys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, key := range keys {
+				if k, ok := key.(string); ok {
+					death.RoutingKeys = append(death.RoutingKeys, k)
+				}
+			}
+		}
+
+		deaths = append(deaths, death)
+	}
+
+	return deaths
+}
@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const errorHeader = "x-error"
+
+// DecodeFailurePolicy decides what happens to a delivery whose body cannot
+// be unmarshalled into the subscription's type.
+type DecodeFailurePolicy int
+
+const (
+	// DecodeFailureDeadLetter moves the message to the dead-letter queue
+	// with the decode error in its x-error header.
+	DecodeFailureDeadLetter DecodeFailurePolicy = iota
+	// DecodeFailureDiscard drops the message.
+	DecodeFailureDiscard
+)
+
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = policy
+	}
+}
+
+// OnDecodeError calls hook for every delivery that fails to decode and
+// settles it with the AckType the hook returns. It takes precedence over
+// the decode failure policy.
+func OnDecodeError(hook func(amqp.Delivery, error) AckType) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onDecodeError = hook
+	}
+}
+
+func (c *consumer) decodeFailed(d amqp.Delivery, decodeErr error) {
+	log.Printf("could not decode message from '%s': %s", c.queueName, decodeErr)
+	exchange, key := deliveryOrigin(d)
+	c.stats.decodeFailures.Inc(c.queueName, exchange, key)
+
+	// The message may well be genuine, so it waits for the key to become
+	// available instead of being dead-lettered.
+	if errors.Is(decodeErr, ErrKeyUnavailable) {
+		if c.options.retry != nil {
+			c.settle(d, RetryLater)
+		} else {
+			c.settle(d, NackRequeue)
+		}
+		return
+	}
+
+	// Forged messages and messages from a newer schema are kept for
+	// inspection whatever the policy.
+	if errors.Is(decodeErr, ErrVerificationFailed) ||
+		errors.Is(decodeErr, ErrUnknownSchemaVersion) {
+		if err := c.deadLetter(d, decodeErr.Error()); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if c.options.onDecodeError != nil {
+		c.settle(d, c.options.onDecodeError(d, decodeErr))
+		return
+	}
+
+	var err error
+	switch c.options.decodeFailure {
+	case DecodeFailureDiscard:
+		err = d.Ack(false)
+	default:
+		err = c.deadLetter(d, decodeErr.Error())
+	}
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// deadLetter publishes d to the dead-letter exchange with reason attached
+// and acks it once the broker has confirmed the copy. If that fails it
+// falls back to letting the broker dead-letter it without the reason.
+func (c *consumer) deadLetter(d amqp.Delivery, reason string) error {
+	msg := republishing(d)
+	msg.Headers[errorHeader] = reason
+
+	if err := c.publisher.PublishMandatory(
+		context.Background(),
+		DeadLetterExchange,
+		d.RoutingKey,
+		msg,
+	); err != nil {
+		log.Printf("could not dead-letter message: %s", err)
+		return d.Nack(false, false)
+	}
+
+	return d.Ack(false)
+}
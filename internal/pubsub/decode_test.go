@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testMove struct {
+	Player string
+}
+
+func publishMalformed(t *testing.T, conn *Connection, key string) {
+	t.Helper()
+
+	if err := conn.Publisher().PublishRaw(
+		context.Background(),
+		testExchange,
+		key,
+		amqp.Publishing{
+			ContentType: JSON.ContentType(),
+			Body:        []byte("{not json"),
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedMessagesAreDeadLetteredWithTheError(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan Message[testMove], 1)
+	subscribeTestQueue(t, conn, "moves.alice", func(msg Message[testMove]) AckType {
+		received <- msg
+		return Ack
+	})
+
+	publishMalformed(t, conn, "moves.alice")
+	if err := PublishJSON(conn, testExchange, "moves.alice", testMove{Player: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bad message does not hold up the one behind it.
+	if msg := receive(t, received); msg.Body.Player != "alice" {
+		t.Errorf("got %+v", msg.Body)
+	}
+
+	eventually(t, func() bool {
+		return broker.QueueLength(DeadLetterQueue) == 1
+	})
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	letter := getTest(t, ch, DeadLetterQueue)
+	if string(letter.Body) != "{not json" {
+		t.Errorf("dead letter body = %q", letter.Body)
+	}
+	if reason, _ := letter.Headers[errorHeader].(string); reason == "" {
+		t.Error("dead letter has no error header")
+	}
+	if exchange, key := deliveryOrigin(letter); exchange != testExchange || key != "moves.alice" {
+		t.Errorf("dead letter came from %s/%s", exchange, key)
+	}
+}
+
+func TestDecodeFailurePolicies(t *testing.T) {
+	for name, test := range map[string]struct {
+		opt        SubscribeOption
+		deadLetter bool
+	}{
+		"discard": {
+			opt: WithDecodeFailurePolicy(DecodeFailureDiscard),
+		},
+		"hook": {
+			opt: OnDecodeError(func(d amqp.Delivery, err error) AckType {
+				return NackDiscard
+			}),
+			deadLetter: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			broker := NewMemoryBroker()
+			conn := newTestConnection(t, broker)
+
+			received := make(chan Message[testMove], 1)
+			subscribeTestQueue(t, conn, "moves.alice", func(msg Message[testMove]) AckType {
+				received <- msg
+				return Ack
+			}, test.opt)
+
+			publishMalformed(t, conn, "moves.alice")
+			if err := PublishJSON(conn, testExchange, "moves.alice", testMove{Player: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, received)
+
+			want := 0
+			if test.deadLetter {
+				want = 1
+			}
+			eventually(t, func() bool {
+				return broker.QueueLength(DeadLetterQueue) == want
+			})
+			if got := broker.QueueLength("moves.alice"); got != 0 {
+				t.Errorf("%d messages left in the queue", got)
+			}
+		})
+	}
+}
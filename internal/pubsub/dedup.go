@@ -0,0 +1,300 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDedupFileInUse = errors.New("pubsub: dedup file is in use by another process")
+
+	errLocked = errors.New("locked")
+)
+
+// DedupStore remembers the IDs of messages that have already been handled.
+type DedupStore interface {
+	Contains(id string) (bool, error)
+	Add(id string) error
+}
+
+// Dedup skips messages whose MessageID is already in store, acking them
+// without calling the handler. An ID is only stored once the handler has
+// settled the message for good, so messages that are requeued or retried
+// are still handled on their next delivery. Messages without an ID are
+// always handled.
+func Dedup[T any](store DedupStore) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) AckType {
+			if msg.MessageID == "" {
+				return next(msg)
+			}
+
+			seen, err := store.Contains(msg.MessageID)
+			if err != nil {
+				log.Printf("could not check message '%s': %s", msg.MessageID, err)
+				return NackRequeue
+			}
+			if seen {
+				log.Printf("skipping duplicate message '%s'", msg.MessageID)
+				return Ack
+			}
+
+			ackType := next(msg)
+			if ackType == Ack || ackType == NackDiscard {
+				if err = store.Add(msg.MessageID); err != nil {
+					log.Printf("could not record message '%s': %s", msg.MessageID, err)
+				}
+			}
+
+			return ackType
+		}
+	}
+}
+
+// MemoryDedupStore keeps up to capacity IDs for ttl each, evicting the
+// least recently added ID when full.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Contains(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[id]
+	if !ok {
+		return false, nil
+	}
+
+	if time.Now().After(elem.Value.(dedupEntry).expires) {
+		s.order.Remove(elem)
+		delete(s.entries, id)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Add(id string) error {
+	s.add(id, time.Now().Add(s.ttl))
+	return nil
+}
+
+func (s *MemoryDedupStore) add(id string, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[id]; ok {
+		s.order.Remove(elem)
+	}
+	s.entries[id] = s.order.PushBack(dedupEntry{id: id, expires: expires})
+
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(dedupEntry).id)
+	}
+}
+
+// liveEntries returns the entries that have not expired, oldest first.
+func (s *MemoryDedupStore) liveEntries() []dedupEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]dedupEntry, 0, s.order.Len())
+	for elem := s.order.Front(); elem != nil; elem = elem.Next() {
+		if entry := elem.Value.(dedupEntry); entry.expires.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// FileDedupStore is a MemoryDedupStore that also appends every ID to a
+// file, so handled IDs survive a restart. The file is rewritten without
+// expired and evicted IDs when it is opened, and again whenever capacity
+// IDs have been appended or ttl has passed, so it stays bounded.
+//
+// Only one process can have the file open at a time. Servers sharing a
+// queue each need a file of their own.
+type FileDedupStore struct {
+	*MemoryDedupStore
+
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	lock      *os.File
+	appended  int
+	compacted time.Time
+}
+
+// OpenFileDedupStore opens the dedup file at path. It fails with
+// ErrDedupFileInUse if another process has it open.
+func OpenFileDedupStore(
+	path string,
+	capacity int,
+	ttl time.Duration,
+) (*FileDedupStore, error) {
+	// The lock lives on a file of its own, because compacting replaces the
+	// dedup file.
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dedup lock file: %v", err)
+	}
+	if err = tryLock(lock); err != nil {
+		lock.Close()
+		if errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrDedupFileInUse, path)
+		}
+		return nil, fmt.Errorf("could not lock dedup file: %v", err)
+	}
+
+	s := &FileDedupStore{
+		MemoryDedupStore: NewMemoryDedupStore(capacity, ttl),
+		path:             path,
+		lock:             lock,
+	}
+	if err = loadDedupFile(path, s.MemoryDedupStore); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err = s.compact(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileDedupStore) Add(id string) error {
+	expires := time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := fmt.Fprintf(s.file, "%d %s\n", expires.UnixNano(), id); err != nil {
+		return fmt.Errorf("could not write dedup file: %v", err)
+	}
+	s.MemoryDedupStore.add(id, expires)
+
+	s.appended++
+	if s.appended >= s.capacity || time.Since(s.compacted) >= s.ttl {
+		if err := s.compact(); err != nil {
+			log.Printf("could not compact dedup file: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the file with only the live IDs and reopens it. Must
+// be called with s.mu held, or before s is shared.
+func (s *FileDedupStore) compact() error {
+	if err := rewriteDedupFile(s.path, s.liveEntries()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open dedup file: %v", err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+	s.appended = 0
+	s.compacted = time.Now()
+
+	return nil
+}
+
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.file.Close()
+	s.lock.Close()
+
+	return err
+}
+
+func loadDedupFile(path string, mem *MemoryDedupStore) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not open dedup file: %v", err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		nanos, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if expires := time.Unix(0, n); expires.After(now) {
+			mem.add(id, expires)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func rewriteDedupFile(path string, entries []dedupEntry) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not rewrite dedup file: %v", err)
+	}
+
+	w := bufio.NewWriter(file)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%d %s\n", entry.expires.UnixNano(), entry.id)
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("could not rewrite dedup file: %v", err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("could not rewrite dedup file: %v", err)
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupSkipsHandledMessages(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	handled := make(chan Message[string], 3)
+	subscribeTestQueue(
+		t,
+		conn,
+		"logs",
+		func(msg Message[string]) AckType {
+			handled <- msg
+			return Ack
+		},
+		WithMiddleware(Dedup[string](NewMemoryDedupStore(10, time.Hour))),
+	)
+
+	for _, id := range []string{"1", "1", "2"} {
+		if err := PublishJSON(conn, testExchange, "logs", id, WithMessageID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"1", "2"} {
+		if msg := receive(t, handled); msg.MessageID != want {
+			t.Errorf("handled %s, want %s", msg.MessageID, want)
+		}
+	}
+}
+
+func TestFileDedupStoreSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.dedup")
+	store, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Add("kept"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if seen, err := store.Contains("kept"); err != nil || !seen {
+		t.Errorf("Contains after reopening = %t, %v", seen, err)
+	}
+}
+
+func TestFileDedupStoreIsNotShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.dedup")
+	store, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err = OpenFileDedupStore(path, 10, time.Hour); !errors.Is(err, ErrDedupFileInUse) {
+		t.Errorf("opening the file twice: got %v, want %v", err, ErrDedupFileInUse)
+	}
+}
+
+func TestFileDedupStoreCompactsWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.dedup")
+	store, err := OpenFileDedupStore(path, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := range 10 {
+		if err = store.Add(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 2*3 {
+		t.Errorf("file has %d lines for a capacity of 3", lines)
+	}
+	if seen, _ := store.Contains("9"); !seen {
+		t.Error("lost the latest ID")
+	}
+}
+
+func TestFileDedupStoreDropsExpiredIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.dedup")
+	store, err := OpenFileDedupStore(path, 10, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.Add("old"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	// The ttl has passed since the last compaction, so this rewrites the
+	// file without the expired ID.
+	if err = store.Add("new"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(" old\n")) {
+		t.Errorf("expired ID is still in the file:\n%s", data)
+	}
+	if seen, _ := store.Contains("old"); seen {
+		t.Error("expired ID is still seen")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package pubsub
+
+import "os"
+
+// tryLock does nothing where flock is not available.
+func tryLock(file *os.File) error {
+	return nil
+}
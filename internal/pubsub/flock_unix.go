@@ -0,0 +1,20 @@
+//go:build unix
+
+package pubsub
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock on file, which is released when it is
+// closed. It fails with errLocked if another open file holds the lock.
+func tryLock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+
+	return err
+}
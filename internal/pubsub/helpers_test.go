@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const testExchange = "test_topic"
+
+// newTestConnection connects to broker and declares the topic exchange the
+// tests publish to.
+func newTestConnection(t *testing.T, broker *MemoryBroker) *Connection {
+	t.Helper()
+
+	conn, err := Connect(broker.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	if err = ch.ExchangeDeclare(testExchange, "topic", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// subscribeTestQueue subscribes a transient queue named after key to the
+// test exchange.
+func subscribeTestQueue[T any](
+	t *testing.T,
+	conn *Connection,
+	key string,
+	handler func(Message[T]) AckType,
+	opts ...TypedSubscribeOption[T],
+) *Subscription {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sub, err := SubscribeMessage(
+		ctx,
+		conn,
+		nil,
+		testExchange,
+		key,
+		key,
+		TransientQueue,
+		handler,
+		opts...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sub
+}
+
+// receive waits for the next value on ch.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	var v T
+	select {
+	case v = <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+
+	return v
+}
+
+// eventually polls check until it returns true.
+func eventually(t *testing.T, check func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,11 +1,10 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"log"
+	"reflect"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -23,219 +22,480 @@ const (
 	Ack         AckType = "ack"
 	NackRequeue         = "nackRequeue"
 	NackDiscard         = "nackDiscard"
+	RetryLater          = "retryLater"
 )
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn *Connection,
 	exchange, queueName, key string,
-	simpleQueueType SimpleQueueType, // enum to represent `durable` or `transient`
-) (*amqp.Channel, amqp.Queue, error) {
-	durable, autoDelete, exclusive := false, false, false
-	if simpleQueueType == DurableQueue {
-		durable = true
-	} else if simpleQueueType == TransientQueue {
-		autoDelete = true
-		exclusive = true
-	}
-
+	queueKind QueueKind,
+) (Channel, amqp.Queue, error) {
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
 
-	queue, err := ch.QueueDeclare(
-		queueName,
-		durable,
-		autoDelete,
-		exclusive,
-		false,
-		amqp.Table{"x-dead-letter-exchange": "peril_dlx"},
-	)
+	queue, err := declareAndBind(ch, exchange, queueName, key, queueKind)
 	if err != nil {
 		return ch, amqp.Queue{}, err
 	}
 
+	return ch, queue, nil
+}
+
+func declareAndBind(
+	ch Channel,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+) (amqp.Queue, error) {
+	queue, err := declareQueue(ch, queueName, queueKind)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
 	if err = ch.QueueBind(queueName, key, exchange, false, nil); err != nil {
-		return ch, amqp.Queue{}, err
+		return amqp.Queue{}, err
 	}
 
-	return ch, queue, nil
+	return queue, nil
+}
+
+// declareQueue declares queueName as described by queueKind.
+func declareQueue(
+	ch Channel,
+	queueName string,
+	queueKind QueueKind,
+) (amqp.Queue, error) {
+	options := queueKind.queueOptions()
+	args, err := queueArguments(queueName, options)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	return ch.QueueDeclare(
+		queueName,
+		options.Durable,
+		options.AutoDelete,
+		options.Exclusive,
+		false,
+		args,
+	)
+}
+
+// queueArguments returns the x-arguments queueName is declared with. The
+// dead-letter queue itself does not dead-letter anywhere.
+func queueArguments(queueName string, options QueueOptions) (amqp.Table, error) {
+	args, err := options.arguments()
+	if err != nil {
+		return nil, err
+	}
+	if queueName == DeadLetterQueue {
+		delete(args, "x-dead-letter-exchange")
+	}
+
+	return args, nil
 }
 
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn *Connection,
 	exchange, queueName, key string,
-	simpleQueueType SimpleQueueType,
+	queueKind QueueKind,
 	handler func(T) AckType,
-) error {
-	if err := subscribe(
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	return Subscribe(
+		ctx,
 		conn,
+		JSON,
 		exchange,
 		queueName,
 		key,
-		simpleQueueType,
+		queueKind,
 		handler,
-		unMarshallJSON,
-	); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func unMarshallJSON[T any](b []byte) (T, error) {
-	var body T
-	buffer := bytes.NewBuffer(b)
-	enc := json.NewDecoder(buffer)
-	if err := enc.Decode(&body); err != nil {
-		return body, err
-	}
-
-	return body, nil
+		opts...,
+	)
 }
 
 func SubscribeGOB[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn *Connection,
 	exchange, queueName, key string,
-	simpleQueueType SimpleQueueType,
+	queueKind QueueKind,
 	handler func(T) AckType,
-) error {
-	if err := subscribe(
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	return Subscribe(
+		ctx,
 		conn,
+		Gob,
 		exchange,
 		queueName,
 		key,
-		simpleQueueType,
+		queueKind,
 		handler,
-		unMarshallGob,
-	); err != nil {
-		return err
-	}
+		opts...,
+	)
+}
 
-	return nil
+// Subscribe consumes queueName and decodes every delivery with codec.
+func Subscribe[T any](
+	ctx context.Context,
+	conn *Connection,
+	codec Codec,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	handler func(T) AckType,
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	return SubscribeMessage(
+		ctx,
+		conn,
+		codec,
+		exchange,
+		queueName,
+		key,
+		queueKind,
+		bodyHandler(handler),
+		opts...,
+	)
 }
 
-func unMarshallGob[T any](b []byte) (T, error) {
-	var body T
+// SubscribeByContentType consumes queueName and decodes every delivery with
+// the registered codec matching its ContentType, so producers using
+// different codecs can share a queue.
+func SubscribeByContentType[T any](
+	ctx context.Context,
+	conn *Connection,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	handler func(T) AckType,
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	return SubscribeMessage(
+		ctx,
+		conn,
+		nil,
+		exchange,
+		queueName,
+		key,
+		queueKind,
+		bodyHandler(handler),
+		opts...,
+	)
+}
 
-	buffer := bytes.NewBuffer(b)
-	enc := gob.NewDecoder(buffer)
-	if err := enc.Decode(&body); err != nil {
-		return body, err
-	}
+// decoder returns a function decoding deliveries with codec, or with the
+// codec matching each delivery's ContentType if codec is nil.
+func decoder[T any](codec Codec) func(amqp.Delivery) (T, error) {
+	return func(d amqp.Delivery) (T, error) {
+		c := codec
+		if c == nil {
+			var err error
+			if c, err = LookupCodec(d.ContentType); err != nil {
+				var zero T
+				return zero, err
+			}
+		}
 
-	return body, nil
+		data, err := decompress(d.ContentEncoding, d.Body)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+
+		return unmarshalVersioned[T](c, d.Headers, data)
+	}
 }
 
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn *Connection,
 	exchange, queueName, key string,
-	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unMarshaller func([]byte) (T, error),
-) error {
-	ch, queue, err := DeclareAndBind(
+	queueKind QueueKind,
+	handler Handler[T],
+	decode func(amqp.Delivery) (T, error),
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	options, typed := newSubscribeOptions(opts)
+	decode = verifying(decode, options.keys, typed.claimed)
+	handler = Chain(handler, typed.middlewares...)
+
+	return startConsumer(
+		ctx,
 		conn,
 		exchange,
 		queueName,
 		key,
-		simpleQueueType,
+		queueKind,
+		options,
+		func(c *consumer, deliveryCh <-chan amqp.Delivery) {
+			consume(c, deliveryCh, handler, decode)
+		},
 	)
-	if err != nil {
-		return err
-	}
+}
 
-	if err = ch.Qos(10, 0, false); err != nil {
-		return err
+// startConsumer declares and binds queueName, consumes it and runs loop on
+// the deliveries, again after every reconnect.
+func startConsumer(
+	ctx context.Context,
+	conn *Connection,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	options subscribeOptions,
+	loop func(*consumer, <-chan amqp.Delivery),
+) (*Subscription, error) {
+	sub := newSubscription(ctx, conn, queueName)
+	sub.setup = func(transport Transport) error {
+		ch, err := transport.Channel()
+		if err != nil {
+			return err
+		}
+
+		queue, err := declareAndBind(
+			ch,
+			exchange,
+			queueName,
+			key,
+			queueKind,
+		)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+
+		if options.retry != nil {
+			if err = declareRetryQueues(
+				ch,
+				queueName,
+				queueKind,
+				*options.retry,
+			); err != nil {
+				ch.Close()
+				return err
+			}
+		}
+
+		if err = ch.Qos(options.prefetchCount(), 0, false); err != nil {
+			ch.Close()
+			return err
+		}
+
+		deliveryCh, err := ch.Consume(
+			queue.Name,
+			sub.tag,
+			false,
+			false,
+			false,
+			false,
+			options.consumeArgs(),
+		)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+
+		c := &consumer{
+			publisher: conn.confirmPublisher,
+			queueName: queueName,
+			options:   options,
+			stats:     conn.stats,
+		}
+		if !sub.start(ch, func() {
+			loop(c, deliveryCh)
+		}) {
+			ch.Close()
+		}
+
+		return nil
 	}
 
-	deliveryCh, err := ch.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return err
+	if err := conn.register(sub); err != nil {
+		sub.cancel()
+		return nil, err
 	}
+	go sub.watch()
 
-	go func() {
-		for delivery := range deliveryCh {
-			body, err := unMarshaller(delivery.Body)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	return sub, nil
+}
 
-			switch handler(body) {
-			case Ack:
-				if err = delivery.Ack(false); err != nil {
-					log.Println(err)
-					continue
-				}
-			case NackRequeue:
-				if err = delivery.Nack(false, true); err != nil {
-					log.Println(err)
-					continue
-				}
-			case NackDiscard:
-				if err = delivery.Nack(false, false); err != nil {
-					log.Println(err)
-					continue
-				}
-			}
+// consumer settles the deliveries of one subscription on the channel they
+// arrived on.
+type consumer struct {
+	publisher *ConfirmPublisher
+	queueName string
+	options   subscribeOptions
+	stats     *connMetrics
+}
+
+func consume[T any](
+	c *consumer,
+	deliveryCh <-chan amqp.Delivery,
+	handler Handler[T],
+	decode func(amqp.Delivery) (T, error),
+) {
+	dispatch(deliveryCh, c.options, func(delivery amqp.Delivery) {
+		c.received(delivery)
+		span := startConsumerSpan(c.queueName, delivery)
+		body, err := decode(delivery)
+		if err != nil {
+			c.decodeFailed(delivery, err)
+			span.finish(err)
+			return
 		}
+
+		msg := newMessage(delivery, body)
+		msg.Trace = span.Context
+
+		var ackType AckType
+		c.timed(1, func() {
+			ackType = handler(msg)
+		})
+		c.settle(delivery, ackType)
+
+		span.Attributes["ack"] = string(ackType)
+		span.finish(nil)
+	})
+}
+
+func (c *consumer) received(d amqp.Delivery) {
+	exchange, key := deliveryOrigin(d)
+	c.stats.consumed.Inc(c.queueName, exchange, key)
+}
+
+// timed runs handle for n messages, tracking them as in flight and
+// recording how long it took.
+func (c *consumer) timed(n int, handle func()) {
+	c.stats.inFlight.Add(float64(n), c.queueName)
+	start := time.Now()
+	defer func() {
+		c.stats.handlerDuration.Observe(time.Since(start).Seconds(), c.queueName)
+		c.stats.inFlight.Add(-float64(n), c.queueName)
 	}()
-	return nil
+
+	handle()
 }
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	data, err := json.Marshal(val)
+func (c *consumer) settle(delivery amqp.Delivery, ackType AckType) {
+	var err error
+	switch ackType {
+	case Ack:
+		err = delivery.Ack(false)
+	case NackRequeue:
+		err = delivery.Nack(false, true)
+	case NackDiscard:
+		err = delivery.Nack(false, false)
+	case RetryLater:
+		err = c.retry(delivery)
+	}
+
 	if err != nil {
-		return err
+		log.Println(err)
 	}
+	c.stats.settled(c.queueName, delivery, ackType)
 
-	err = ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        data,
-		},
-	)
+	if c.options.stream != nil {
+		c.options.stream.advance(delivery)
+	}
+}
+
+func PublishJSON[T any](
+	conn *Connection,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	return Publish(conn, JSON, exchange, key, val, opts...)
+}
+
+func PublishGob[T any](
+	conn *Connection,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	return Publish(conn, Gob, exchange, key, val, opts...)
+}
+
+func Publish[T any](
+	conn *Connection,
+	codec Codec,
+	exchange, key string,
+	val T,
+	opts ...PublishOption,
+) error {
+	msg, err := marshal(codec, key, val, opts)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return conn.publisher.PublishRaw(context.Background(), exchange, key, msg)
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	if err := enc.Encode(val); err != nil {
-		return err
+// marshal encodes val as a message to be published with key. Signing
+// happens last, once the options have set everything the signature covers.
+func marshal[T any](
+	codec Codec,
+	key string,
+	val T,
+	opts []PublishOption,
+) (amqp.Publishing, error) {
+	data, err := codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, err
 	}
 
-	if err := ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        b.Bytes(),
+	options := publishOptions{
+		Publishing: amqp.Publishing{
+			Headers: amqp.Table{
+				schemaVersionHeader: int32(schemaVersion(reflect.TypeOf(val))),
+			},
+			ContentType: codec.ContentType(),
+			Body:        data,
 		},
-	); err != nil {
-		return err
 	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	msg := options.Publishing
+	if msg.MessageId == "" {
+		msg.MessageId = newID()
+	}
+	if options.signer != nil {
+		if err = sign(&msg, key, options.signer); err != nil {
+			return amqp.Publishing{}, err
+		}
+	}
+
+	return msg, nil
+}
 
-	return nil
+// republishing copies d into a Publishing so it can be sent again with the
+// same properties. The headers are copied so they can be changed safely,
+// and remember where d was first published.
+func republishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[originalExchangeHeader]; !ok {
+		headers[originalExchangeHeader] = d.Exchange
+		headers[originalKeyHeader] = d.RoutingKey
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
 }
@@ -0,0 +1,1464 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It emulates the
+// default, direct, fanout and topic exchanges, durable and transient
+// queues, prefetch, acks and nacks, message TTLs, dead-lettering,
+// publisher confirms and direct reply-to, which is enough to run the whole
+// game without a broker.
+type MemoryBroker struct {
+	mu          sync.Mutex
+	exchanges   map[string]*memExchange
+	queues      map[string]*memQueue
+	connections map[*memConnection]struct{}
+	nextID      int
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{
+			"": {name: "", kind: amqp.ExchangeDirect, durable: true},
+		},
+		queues:      map[string]*memQueue{},
+		connections: map[*memConnection]struct{}{},
+	}
+}
+
+// Dial opens a new connection to the broker. It has the signature of a
+// Dialer, so b.Dial can be passed to Connect.
+func (b *MemoryBroker) Dial() (Transport, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	conn := &memConnection{
+		broker:   b,
+		channels: map[*memChannel]struct{}{},
+	}
+	b.connections[conn] = struct{}{}
+
+	return conn, nil
+}
+
+// Restart simulates a broker restart: every connection is closed with an
+// error, and transient queues and exchanges are lost.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.connections {
+		conn.close(&amqp.Error{
+			Code:   amqp.ConnectionForced,
+			Reason: "broker restarted",
+			Server: true,
+		})
+	}
+
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+		}
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+// QueueLength returns how many messages are ready in queue.
+func (b *MemoryBroker) QueueLength(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0
+	}
+
+	return len(q.ready)
+}
+
+func (b *MemoryBroker) newName(prefix string) string {
+	b.nextID++
+	return prefix + strconv.Itoa(b.nextID)
+}
+
+type memExchange struct {
+	name     string
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+}
+
+func (ex *memExchange) matches(binding, key string) bool {
+	switch ex.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(strings.Split(binding, "."), strings.Split(key, "."))
+	default:
+		return binding == key
+	}
+}
+
+// topicMatch reports whether the words of a routing key match a binding
+// pattern, where `*` matches exactly one word and `#` zero or more.
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 &&
+			pattern[0] == words[0] &&
+			topicMatch(pattern[1:], words[1:])
+	}
+}
+
+type memMessage struct {
+	msg         amqp.Publishing
+	exchange    string
+	key         string
+	redelivered bool
+	requeues    int64
+	expiry      *time.Timer
+
+	// offset and arrived are only set on stream messages.
+	offset  int64
+	arrived time.Time
+}
+
+type memQueue struct {
+	name        string
+	durable     bool
+	autoDelete  bool
+	exclusive   bool
+	owner       *memConnection
+	args        amqp.Table
+	ready       []*memMessage
+	consumers   []*memConsumer
+	next        int
+	hadConsumer bool
+	deleted     bool
+
+	// A stream keeps every message in log and each consumer reads it from
+	// its own cursor.
+	stream bool
+	log    []*memMessage
+}
+
+func (q *memQueue) remove(m *memMessage) bool {
+	for i, ready := range q.ready {
+		if ready == m {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type memConsumer struct {
+	tag      string
+	ch       *memChannel
+	queue    *memQueue
+	autoAck  bool
+	prefetch int
+	unacked  int
+
+	cursor int64
+
+	buffer    []amqp.Delivery
+	cond      *sync.Cond
+	out       chan amqp.Delivery
+	stop      chan struct{}
+	cancelled bool
+}
+
+func (c *memConsumer) hasCapacity() bool {
+	return !c.cancelled && (c.autoAck || c.prefetch <= 0 || c.unacked < c.prefetch)
+}
+
+// pump hands buffered deliveries to the client without holding the broker
+// lock. Like amqp091 it keeps delivering what is buffered after a cancel
+// and only closes the delivery channel once the buffer is drained.
+func (c *memConsumer) pump() {
+	defer close(c.out)
+
+	c.cond.L.Lock()
+	for {
+		for len(c.buffer) == 0 && !c.cancelled {
+			c.cond.Wait()
+		}
+		if len(c.buffer) == 0 {
+			c.cond.L.Unlock()
+			return
+		}
+
+		d := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		c.cond.L.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.stop:
+			return
+		}
+
+		c.cond.L.Lock()
+	}
+}
+
+type memUnacked struct {
+	message  *memMessage
+	queue    *memQueue
+	consumer *memConsumer
+}
+
+type memConnection struct {
+	broker    *MemoryBroker
+	channels  map[*memChannel]struct{}
+	listeners []chan *amqp.Error
+	closed    bool
+}
+
+func (conn *memConnection) Channel() (Channel, error) {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if conn.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &memChannel{
+		conn:      conn,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+	}
+	ch.noticeCond = sync.NewCond(&b.mu)
+	conn.channels[ch] = struct{}{}
+
+	return ch, nil
+}
+
+func (conn *memConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if conn.closed {
+		close(receiver)
+		return receiver
+	}
+	conn.listeners = append(conn.listeners, receiver)
+
+	return receiver
+}
+
+func (conn *memConnection) Close() error {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if conn.closed {
+		return amqp.ErrClosed
+	}
+	conn.close(nil)
+
+	return nil
+}
+
+// close must be called with the broker lock held.
+func (conn *memConnection) close(err *amqp.Error) {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+
+	b := conn.broker
+	for ch := range conn.channels {
+		ch.close()
+	}
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == conn {
+			b.deleteQueue(q)
+		}
+	}
+	delete(b.connections, conn)
+
+	for _, listener := range conn.listeners {
+		if err != nil {
+			listener <- err
+		}
+		close(listener)
+	}
+}
+
+type memChannel struct {
+	conn      *memConnection
+	closed    bool
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]*memUnacked
+	consumers map[string]*memConsumer
+	replyTo   *memQueue
+
+	confirming      bool
+	publishSeq      uint64
+	notices         []memNotice
+	pumping         bool
+	noticeCond      *sync.Cond
+	listeners       []chan amqp.Confirmation
+	returnListeners []chan amqp.Return
+}
+
+// memNotice is a confirmation or a returned mandatory publish waiting to be
+// handed to the channel's listeners.
+type memNotice struct {
+	confirm *amqp.Confirmation
+	ret     *amqp.Return
+}
+
+func (ch *memChannel) broker() *MemoryBroker {
+	return ch.conn.broker
+}
+
+func (ch *memChannel) lock() (*MemoryBroker, error) {
+	b := ch.broker()
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+
+	return b, nil
+}
+
+func (ch *memChannel) ExchangeDeclare(
+	name, kind string,
+	durable, autoDelete, internal, noWait bool,
+	args amqp.Table,
+) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return fmt.Errorf("memory broker does not support '%s' exchanges", kind)
+	}
+
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return &amqp.Error{
+				Code: amqp.PreconditionFailed,
+				Reason: fmt.Sprintf(
+					"PRECONDITION_FAILED - exchange '%s' already declared as '%s'",
+					name,
+					ex.kind,
+				),
+			}
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable}
+
+	return nil
+}
+
+// ExchangeDeclarePassive fails with a 404 if the exchange does not exist,
+// like RabbitMQ, but does not close the channel.
+func (ch *memChannel) ExchangeDeclarePassive(
+	name, kind string,
+	durable, autoDelete, internal, noWait bool,
+	args amqp.Table,
+) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[name]; !ok {
+		return &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name),
+		}
+	}
+
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(
+	name string,
+	durable, autoDelete, exclusive, noWait bool,
+	args amqp.Table,
+) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+
+	if name == "" {
+		name = b.newName("amq.gen-")
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, &amqp.Error{
+				Code: amqp.ResourceLocked,
+				Reason: fmt.Sprintf(
+					"RESOURCE_LOCKED - queue '%s' is exclusive to another connection",
+					name,
+				),
+			}
+		}
+		if q.durable != durable {
+			return amqp.Queue{}, &amqp.Error{
+				Code: amqp.PreconditionFailed,
+				Reason: fmt.Sprintf(
+					"PRECONDITION_FAILED - queue '%s' already declared with durable=%t",
+					name,
+					q.durable,
+				),
+			}
+		}
+		if queueType(q.args) != queueType(args) {
+			return amqp.Queue{}, &amqp.Error{
+				Code: amqp.PreconditionFailed,
+				Reason: fmt.Sprintf(
+					"PRECONDITION_FAILED - inequivalent arg 'x-queue-type' for queue '%s': received '%s' but current is '%s'",
+					name,
+					queueType(args),
+					queueType(q.args),
+				),
+			}
+		}
+		return amqp.Queue{
+			Name:      name,
+			Messages:  len(q.ready),
+			Consumers: len(q.consumers),
+		}, nil
+	}
+
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		stream:     args["x-queue-type"] == string(StreamQueue),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+
+	return amqp.Queue{Name: name}, nil
+}
+
+// QueueDeclarePassive fails with a 404 if the queue does not exist, like
+// RabbitMQ, but does not close the channel.
+func (ch *memChannel) QueueDeclarePassive(
+	name string,
+	durable, autoDelete, exclusive, noWait bool,
+	args amqp.Table,
+) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name),
+		}
+	}
+
+	return amqp.Queue{
+		Name:      name,
+		Messages:  len(q.ready),
+		Consumers: len(q.consumers),
+	}, nil
+}
+
+func (ch *memChannel) QueueBind(
+	name, key, exchange string,
+	noWait bool,
+	args amqp.Table,
+) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return fmt.Errorf("no queue '%s'", name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return fmt.Errorf("no exchange '%s'", exchange)
+	}
+
+	for _, binding := range ex.bindings {
+		if binding.queue == q && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: q, key: key})
+
+	return nil
+}
+
+func (ch *memChannel) QueueUnbind(
+	name, key, exchange string,
+	args amqp.Table,
+) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return fmt.Errorf("no queue '%s'", name)
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("no exchange '%s'", exchange)
+	}
+
+	ex.bindings = slices.DeleteFunc(ex.bindings, func(binding memBinding) bool {
+		return binding.queue == q && binding.key == key
+	})
+
+	return nil
+}
+
+// QueueDelete deletes the queue and returns how many messages it held.
+// Like RabbitMQ, deleting a queue that does not exist succeeds.
+func (ch *memChannel) QueueDelete(
+	name string,
+	ifUnused, ifEmpty, noWait bool,
+) (int, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, &amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in use", name),
+		}
+	}
+	if ifEmpty && len(q.ready) > 0 {
+		return 0, &amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - queue '%s' not empty", name),
+		}
+	}
+
+	n := len(q.ready)
+	b.deleteQueue(q)
+
+	return n, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, fmt.Errorf("no queue '%s'", name)
+	}
+
+	n := len(q.ready)
+	for _, m := range q.ready {
+		m.stopExpiry()
+	}
+	q.ready = nil
+
+	return n, nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ch.prefetch = prefetchCount
+
+	return nil
+}
+
+func (ch *memChannel) Consume(
+	queue, consumer string,
+	autoAck, exclusive, noLocal, noWait bool,
+	args amqp.Table,
+) (<-chan amqp.Delivery, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	var q *memQueue
+	if queue == directReplyTo {
+		if !autoAck {
+			return nil, fmt.Errorf("direct reply-to needs auto-ack")
+		}
+		q = &memQueue{name: b.newName(directReplyTo + ".")}
+		b.queues[q.name] = q
+		ch.replyTo = q
+	} else if q = b.queues[queue]; q == nil {
+		return nil, fmt.Errorf("no queue '%s'", queue)
+	}
+
+	var cursor int64
+	if q.stream {
+		if autoAck {
+			return nil, fmt.Errorf("consuming stream '%s' needs manual acks", queue)
+		}
+		cursor = q.streamCursor(args[streamOffsetHeader])
+	}
+
+	if consumer == "" {
+		consumer = b.newName("ctag-")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, fmt.Errorf("consumer tag '%s' already in use", consumer)
+	}
+
+	c := &memConsumer{
+		tag:      consumer,
+		ch:       ch,
+		queue:    q,
+		autoAck:  autoAck,
+		prefetch: ch.prefetch,
+		cursor:   cursor,
+		cond:     sync.NewCond(&b.mu),
+		out:      make(chan amqp.Delivery),
+		stop:     make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.hadConsumer = true
+	go c.pump()
+
+	b.dispatch(q)
+
+	return c.out, nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, fmt.Errorf("no queue '%s'", queue)
+	}
+	if q.stream {
+		return amqp.Delivery{}, false, fmt.Errorf("stream '%s' cannot be read with get", queue)
+	}
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	m.stopExpiry()
+
+	d := ch.deliver(q, m, nil, autoAck)
+	d.MessageCount = uint32(len(q.ready))
+
+	return d, true, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return fmt.Errorf("no consumer '%s'", consumer)
+	}
+	b.cancel(c)
+
+	return nil
+}
+
+func (ch *memChannel) PublishWithContext(
+	ctx context.Context,
+	exchange, key string,
+	mandatory, immediate bool,
+	msg amqp.Publishing,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[exchange]; !ok {
+		return fmt.Errorf("no exchange '%s'", exchange)
+	}
+
+	if msg.ReplyTo == directReplyTo {
+		if ch.replyTo == nil {
+			return fmt.Errorf("publish with direct reply-to before consuming replies")
+		}
+		msg.ReplyTo = ch.replyTo.name
+	}
+
+	routed, accepted := b.route(exchange, key, msg)
+
+	// As on RabbitMQ, an unroutable mandatory publish is returned before it
+	// is confirmed.
+	if mandatory && !routed && len(ch.returnListeners) > 0 {
+		ch.notices = append(ch.notices, memNotice{ret: &amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         copyTable(msg.Headers),
+			MessageId:       msg.MessageId,
+			Body:            msg.Body,
+		}})
+		ch.noticeCond.Broadcast()
+	}
+	if ch.confirming {
+		ch.publishSeq++
+		ch.notices = append(ch.notices, memNotice{confirm: &amqp.Confirmation{
+			DeliveryTag: ch.publishSeq,
+			Ack:         accepted,
+		}})
+		ch.noticeCond.Broadcast()
+	}
+
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ch.confirming = true
+	ch.startPump()
+
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.listeners = append(ch.listeners, confirm)
+
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(ret chan amqp.Return) chan amqp.Return {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		close(ret)
+		return ret
+	}
+	ch.returnListeners = append(ch.returnListeners, ret)
+	ch.startPump()
+
+	return ret
+}
+
+func (ch *memChannel) GetNextPublishSeqNo() uint64 {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return ch.publishSeq + 1
+}
+
+// startPump starts pump once. Must be called with the broker lock held.
+func (ch *memChannel) startPump() {
+	if !ch.pumping {
+		ch.pumping = true
+		go ch.pump()
+	}
+}
+
+// pump delivers confirmations and returns in order without holding the
+// broker lock, so a slow listener cannot block publishing.
+func (ch *memChannel) pump() {
+	b := ch.broker()
+	b.mu.Lock()
+	for {
+		for len(ch.notices) == 0 && !ch.closed {
+			ch.noticeCond.Wait()
+		}
+		if ch.closed {
+			listeners, returnListeners := ch.listeners, ch.returnListeners
+			b.mu.Unlock()
+			closeListeners(listeners, returnListeners)
+			return
+		}
+
+		notice := ch.notices[0]
+		ch.notices = ch.notices[1:]
+		listeners, returnListeners := ch.listeners, ch.returnListeners
+		b.mu.Unlock()
+
+		if notice.ret != nil {
+			for _, listener := range returnListeners {
+				listener <- *notice.ret
+			}
+		} else {
+			for _, listener := range listeners {
+				listener <- *notice.confirm
+			}
+		}
+
+		b.mu.Lock()
+	}
+}
+
+func closeListeners(listeners []chan amqp.Confirmation, returnListeners []chan amqp.Return) {
+	for _, listener := range listeners {
+		close(listener)
+	}
+	for _, listener := range returnListeners {
+		close(listener)
+	}
+}
+
+func (ch *memChannel) IsClosed() bool {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return ch.closed
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.close()
+
+	return nil
+}
+
+// close must be called with the broker lock held. Deliveries the channel
+// has not settled go back to their queues, as they would on RabbitMQ.
+func (ch *memChannel) close() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+
+	b := ch.broker()
+	for _, c := range ch.consumers {
+		close(c.stop)
+		c.buffer = nil
+		b.cancel(c)
+	}
+	ch.requeue(ch.unackedTags(^uint64(0), true))
+
+	if ch.replyTo != nil {
+		b.deleteQueue(ch.replyTo)
+	}
+	delete(ch.conn.channels, ch)
+
+	if ch.pumping {
+		ch.noticeCond.Broadcast()
+	} else {
+		closeListeners(ch.listeners, ch.returnListeners)
+	}
+}
+
+// deliver records m as delivered on ch and builds the delivery for it.
+// Must be called with the broker lock held.
+func (ch *memChannel) deliver(
+	q *memQueue,
+	m *memMessage,
+	c *memConsumer,
+	autoAck bool,
+) amqp.Delivery {
+	ch.nextTag++
+	tag := ch.nextTag
+
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{message: m, queue: q, consumer: c}
+		if c != nil {
+			c.unacked++
+		}
+	}
+
+	headers := m.msg.Headers
+	if q.stream {
+		headers = copyTable(headers)
+		if headers == nil {
+			headers = amqp.Table{}
+		}
+		headers[streamOffsetHeader] = m.offset
+	}
+
+	d := amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+	if c != nil {
+		d.ConsumerTag = c.tag
+	}
+
+	return d
+}
+
+// unackedTags returns the unacked delivery tags up to tag, or just tag
+// unless multiple is set, in ascending order.
+func (ch *memChannel) unackedTags(tag uint64, multiple bool) []uint64 {
+	if !multiple {
+		if _, ok := ch.unacked[tag]; ok {
+			return []uint64{tag}
+		}
+		return nil
+	}
+
+	tags := []uint64{}
+	for t := range ch.unacked {
+		if t <= tag {
+			tags = append(tags, t)
+		}
+	}
+	slices.Sort(tags)
+
+	return tags
+}
+
+func (ch *memChannel) settle(tags []uint64) []*memUnacked {
+	settled := make([]*memUnacked, 0, len(tags))
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		if u.consumer != nil {
+			u.consumer.unacked--
+		}
+		settled = append(settled, u)
+	}
+
+	return settled
+}
+
+// requeue puts the deliveries back at the head of their queues in their
+// original order.
+func (ch *memChannel) requeue(tags []uint64) {
+	b := ch.broker()
+	settled := ch.settle(tags)
+	for i := len(settled) - 1; i >= 0; i-- {
+		u := settled[i]
+		if u.queue.deleted || u.queue.stream {
+			continue
+		}
+		u.message.redelivered = true
+		u.message.requeues++
+		if limit, ok := tableInt(u.queue.args, "x-delivery-limit"); ok &&
+			u.message.requeues > limit {
+			b.deadLetter(u.queue, u.message, "delivery_limit")
+			continue
+		}
+		u.queue.ready = append([]*memMessage{u.message}, u.queue.ready...)
+	}
+	for _, u := range settled {
+		b.dispatch(u.queue)
+	}
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	tags := ch.unackedTags(tag, multiple)
+	if len(tags) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	for _, u := range ch.settle(tags) {
+		b.dispatch(u.queue)
+	}
+
+	return nil
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	tags := ch.unackedTags(tag, multiple)
+	if len(tags) == 0 {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+
+	if requeue {
+		ch.requeue(tags)
+		return nil
+	}
+
+	for _, u := range ch.settle(tags) {
+		b.deadLetter(u.queue, u.message, "rejected")
+		b.dispatch(u.queue)
+	}
+
+	return nil
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// The methods below must be called with the broker lock held.
+
+// route delivers msg to every queue bound to exchange with a matching key.
+// It reports whether any queue matched, and false for accepted if a full
+// queue rejected it.
+func (b *MemoryBroker) route(exchange, key string, msg amqp.Publishing) (routed, accepted bool) {
+	ex := b.exchanges[exchange]
+	if ex == nil {
+		return false, true
+	}
+
+	accepted = true
+	targets := []*memQueue{}
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	}
+	for _, binding := range ex.bindings {
+		if ex.matches(binding.key, key) && !containsQueue(targets, binding.queue) {
+			targets = append(targets, binding.queue)
+		}
+	}
+
+	for _, q := range targets {
+		m := &memMessage{
+			msg:      msg,
+			exchange: exchange,
+			key:      key,
+		}
+		m.msg.Headers = copyTable(msg.Headers)
+		if !b.enqueue(q, m) {
+			accepted = false
+		}
+	}
+
+	return len(targets) > 0, accepted
+}
+
+func containsQueue(queues []*memQueue, q *memQueue) bool {
+	for _, queue := range queues {
+		if queue == q {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enqueue appends m to q, making room according to the queue's overflow
+// mode if it is full. It reports false if m was rejected.
+func (b *MemoryBroker) enqueue(q *memQueue, m *memMessage) bool {
+	if q.stream {
+		m.offset = int64(len(q.log))
+		m.arrived = time.Now()
+		q.log = append(q.log, m)
+		b.dispatch(q)
+		return true
+	}
+
+	if maxLength, ok := tableInt(q.args, "x-max-length"); ok &&
+		int64(len(q.ready)) >= maxLength {
+		if q.args["x-overflow"] == string(OverflowRejectPublish) {
+			return false
+		}
+		for int64(len(q.ready)) >= maxLength && len(q.ready) > 0 {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			head.stopExpiry()
+			b.deadLetter(q, head, "maxlen")
+		}
+		if maxLength == 0 {
+			b.deadLetter(q, m, "maxlen")
+			return true
+		}
+	}
+
+	q.ready = slices.Insert(q.ready, q.insertAt(m), m)
+
+	if ttl, ok := messageTTL(q, m); ok {
+		m.expiry = time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if q.remove(m) {
+				b.deadLetter(q, m, "expired")
+			}
+		})
+	}
+
+	b.dispatch(q)
+
+	return true
+}
+
+// insertAt returns where m goes in the ready list: at the end, or on a
+// priority queue behind every message with at least its priority.
+func (q *memQueue) insertAt(m *memMessage) int {
+	maxPriority, ok := tableInt(q.args, "x-max-priority")
+	if !ok {
+		return len(q.ready)
+	}
+
+	priority := min(int64(m.msg.Priority), maxPriority)
+	for i, ready := range q.ready {
+		if min(int64(ready.msg.Priority), maxPriority) < priority {
+			return i
+		}
+	}
+
+	return len(q.ready)
+}
+
+func (m *memMessage) stopExpiry() {
+	if m.expiry != nil {
+		m.expiry.Stop()
+		m.expiry = nil
+	}
+}
+
+func messageTTL(q *memQueue, m *memMessage) (time.Duration, bool) {
+	ttl, ok := tableInt(q.args, "x-message-ttl")
+	if m.msg.Expiration != "" {
+		if ms, err := strconv.ParseInt(m.msg.Expiration, 10, 64); err == nil &&
+			(!ok || ms < ttl) {
+			ttl, ok = ms, true
+		}
+	}
+
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+// queueType is the x-queue-type a queue was declared with. Queues without
+// one are classic.
+func queueType(args amqp.Table) string {
+	if t, ok := args["x-queue-type"].(string); ok {
+		return t
+	}
+
+	return string(ClassicQueue)
+}
+
+func tableInt(table amqp.Table, key string) (int64, bool) {
+	return toInt64(table[key])
+}
+
+func toInt64(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// dispatch hands ready messages to consumers with spare prefetch capacity,
+// round-robin.
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	if q.stream {
+		b.dispatchStream(q)
+		return
+	}
+
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		m.stopExpiry()
+
+		c.buffer = append(c.buffer, c.ch.deliver(q, m, c, c.autoAck))
+		c.cond.Signal()
+	}
+}
+
+// dispatchStream hands every consumer of a stream the messages past its
+// cursor that fit in its prefetch window.
+func (b *MemoryBroker) dispatchStream(q *memQueue) {
+	for _, c := range q.consumers {
+		for c.cursor < int64(len(q.log)) && c.hasCapacity() {
+			m := q.log[c.cursor]
+			c.cursor++
+			c.buffer = append(c.buffer, c.ch.deliver(q, m, c, false))
+			c.cond.Signal()
+		}
+	}
+}
+
+// streamCursor resolves an x-stream-offset argument to a position in the
+// log. Without one a consumer only sees new messages.
+func (q *memQueue) streamCursor(offset any) int64 {
+	end := int64(len(q.log))
+	switch offset := offset.(type) {
+	case string:
+		switch offset {
+		case "first":
+			return 0
+		case "last":
+			return max(end-1, 0)
+		}
+	case time.Time:
+		for i, m := range q.log {
+			if !m.arrived.Before(offset) {
+				return int64(i)
+			}
+		}
+	default:
+		if n, ok := toInt64(offset); ok {
+			return min(max(n, 0), end)
+		}
+	}
+
+	return end
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := range q.consumers {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.hasCapacity() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) cancel(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	c.cond.Signal()
+
+	delete(c.ch.consumers, c.tag)
+	q := c.queue
+	for i, consumer := range q.consumers {
+		if consumer == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	q.next = 0
+
+	if q.autoDelete && q.hadConsumer && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+	}
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+
+	for _, m := range q.ready {
+		m.stopExpiry()
+	}
+	q.ready = nil
+	for _, c := range slices.Clone(q.consumers) {
+		b.cancel(c)
+	}
+	delete(b.queues, q.name)
+
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+}
+
+// deadLetter republishes m to the queue's dead-letter exchange, if it has
+// one, recording the death in the x-death header like RabbitMQ does.
+func (b *MemoryBroker) deadLetter(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+
+	key := m.key
+	if dlrk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlrk
+	}
+
+	msg := m.msg
+	msg.Headers = copyTable(m.msg.Headers)
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Expiration = ""
+	recordDeath(msg.Headers, q.name, reason, m.exchange, m.key)
+
+	b.route(dlx, key, msg)
+}
+
+func recordDeath(headers amqp.Table, queue, reason, exchange, key string) {
+	deaths, _ := headers["x-death"].([]interface{})
+	count := int64(1)
+	rest := []interface{}{}
+	for _, entry := range deaths {
+		table, ok := entry.(amqp.Table)
+		if ok && table["queue"] == queue && table["reason"] == reason {
+			n, _ := table["count"].(int64)
+			count = n + 1
+			continue
+		}
+		rest = append(rest, entry)
+	}
+
+	death := amqp.Table{
+		"queue":        queue,
+		"reason":       reason,
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+		"count":        count,
+		"time":         time.Now(),
+	}
+	headers["x-death"] = append([]interface{}{death}, rest...)
+
+	if _, ok := headers["x-first-death-exchange"]; !ok {
+		headers["x-first-death-exchange"] = exchange
+		headers["x-first-death-queue"] = queue
+		headers["x-first-death-reason"] = reason
+	}
+}
+
+func copyTable(table amqp.Table) amqp.Table {
+	if table == nil {
+		return nil
+	}
+
+	copied := amqp.Table{}
+	for k, v := range table {
+		copied[k] = v
+	}
+
+	return copied
+}
@@ -0,0 +1,265 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declareTestQueue declares queueName bound to the test exchange with key
+// and returns a channel to use it on.
+func declareTestQueue(
+	t *testing.T,
+	conn *Connection,
+	queueName, key string,
+	queueKind QueueKind,
+) Channel {
+	t.Helper()
+
+	ch, _, err := DeclareAndBind(conn, testExchange, queueName, key, queueKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ch.Close()
+	})
+
+	return ch
+}
+
+func publishTest(t *testing.T, ch Channel, key string, msg amqp.Publishing) {
+	t.Helper()
+
+	if err := ch.PublishWithContext(
+		context.Background(),
+		testExchange,
+		key,
+		false,
+		false,
+		msg,
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTest(t *testing.T, ch Channel, queueName string) amqp.Delivery {
+	t.Helper()
+
+	d, ok, err := ch.Get(queueName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("queue %s is empty", queueName)
+	}
+
+	return d
+}
+
+func TestMemoryTopicWildcards(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "one_word", "moves.*", DurableQueue)
+	declareTestQueue(t, conn, "any_words", "moves.#", DurableQueue)
+	declareTestQueue(t, conn, "suffix", "#.alice", DurableQueue)
+	declareTestQueue(t, conn, "exact", "moves.alice", DurableQueue)
+
+	for _, key := range []string{
+		"moves",
+		"moves.alice",
+		"moves.bob",
+		"moves.alice.europe",
+		"war.alice",
+	} {
+		publishTest(t, ch, key, amqp.Publishing{Body: []byte(key)})
+	}
+
+	for queue, want := range map[string]int{
+		"one_word":  2, // moves.alice, moves.bob
+		"any_words": 4, // everything under moves, including moves itself
+		"suffix":    2, // moves.alice, war.alice
+		"exact":     1,
+	} {
+		if got := broker.QueueLength(queue); got != want {
+			t.Errorf("%s has %d messages, want %d", queue, got, want)
+		}
+	}
+}
+
+func TestMemoryRestartKeepsOnlyDurableQueues(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "durable", "durable", DurableQueue)
+	declareTestQueue(t, conn, "transient", "transient", QueueOptions{})
+	publishTest(t, ch, "durable", amqp.Publishing{Body: []byte("kept")})
+	publishTest(t, ch, "transient", amqp.Publishing{Body: []byte("lost")})
+
+	received := make(chan Message[string], 1)
+	subscribeTestQueue(t, conn, "subscribed", func(msg Message[string]) AckType {
+		received <- msg
+		return Ack
+	})
+
+	broker.Restart()
+
+	if got := broker.QueueLength("durable"); got != 1 {
+		t.Errorf("durable queue has %d messages after the restart, want 1", got)
+	}
+
+	// The connection comes back and redeclares its subscriptions, but
+	// nothing redeclares the plain transient queue.
+	eventually(t, func() bool {
+		ch, err := conn.Channel()
+		if err != nil {
+			return false
+		}
+		defer ch.Close()
+
+		_, err = ch.QueueDeclarePassive("subscribed", false, true, true, false, nil)
+		return err == nil
+	})
+
+	err := withChannel(conn, func(ch Channel) error {
+		_, err := ch.QueueDeclarePassive("transient", false, false, false, false, nil)
+		return err
+	})
+	if err == nil {
+		t.Error("transient queue survived the restart")
+	}
+
+	if err = PublishJSON(conn, testExchange, "subscribed", "after restart"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg.Body != "after restart" {
+		t.Errorf("got %q after the restart", msg.Body)
+	}
+}
+
+func TestMemoryPrefetchCapsUnackedDeliveries(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "work", "work", DurableQueue)
+	if err := ch.Qos(2, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume("work", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 5 {
+		publishTest(t, ch, "work", amqp.Publishing{Body: []byte("job")})
+	}
+
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+	select {
+	case <-deliveries:
+		t.Fatal("got a third delivery with a prefetch of 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := broker.QueueLength("work"); got != 3 {
+		t.Errorf("%d messages still ready, want 3", got)
+	}
+
+	if err = first.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+}
+
+func TestMemoryRequeueKeepsOrder(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "ordered", "ordered", DurableQueue)
+	for _, body := range []string{"1", "2", "3"} {
+		publishTest(t, ch, "ordered", amqp.Publishing{Body: []byte(body)})
+	}
+
+	getTest(t, ch, "ordered")
+	second := getTest(t, ch, "ordered")
+	// Requeues both unacked deliveries.
+	if err := second.Nack(true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"1", "2", "3"} {
+		d := getTest(t, ch, "ordered")
+		if string(d.Body) != want {
+			t.Errorf("got %s, want %s", d.Body, want)
+		}
+		if d.Redelivered != (want != "3") {
+			t.Errorf("message %s: redelivered = %t", want, d.Redelivered)
+		}
+		if err := d.Ack(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryRejectedMessagesAreDeadLettered(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "moves", "moves.*", DurableQueue)
+	publishTest(t, ch, "moves.alice", amqp.Publishing{Body: []byte("move")})
+
+	d := getTest(t, ch, "moves")
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	letter := getTest(t, ch, DeadLetterQueue)
+	deaths := parseXDeath(letter.Headers)
+	if len(deaths) != 1 {
+		t.Fatalf("x-death = %#v, want one entry", letter.Headers["x-death"])
+	}
+	death := deaths[0]
+	if death.Queue != "moves" || death.Reason != "rejected" || death.Exchange != testExchange ||
+		death.Count != 1 || len(death.RoutingKeys) != 1 || death.RoutingKeys[0] != "moves.alice" {
+		t.Errorf("x-death = %+v", death)
+	}
+	if letter.Headers["x-first-death-reason"] != "rejected" {
+		t.Errorf("x-first-death-reason = %v", letter.Headers["x-first-death-reason"])
+	}
+}
+
+func TestMemoryExpiredMessagesAreDeadLettered(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch := declareTestQueue(t, conn, "short", "short", QueueOptions{
+		Durable:    true,
+		MessageTTL: 20 * time.Millisecond,
+	})
+	declareTestQueue(t, conn, "long", "long", DurableQueue)
+
+	publishTest(t, ch, "short", amqp.Publishing{Body: []byte("queue ttl")})
+	publishTest(t, ch, "long", amqp.Publishing{Body: []byte("message ttl"), Expiration: "20"})
+	publishTest(t, ch, "long", amqp.Publishing{Body: []byte("no ttl")})
+
+	eventually(t, func() bool {
+		return broker.QueueLength(DeadLetterQueue) == 2
+	})
+
+	for range 2 {
+		letter := getTest(t, ch, DeadLetterQueue)
+		deaths := parseXDeath(letter.Headers)
+		if len(deaths) != 1 || deaths[0].Reason != "expired" {
+			t.Errorf("%s: x-death = %+v", letter.Body, deaths)
+		}
+		if letter.Expiration != "" {
+			t.Errorf("%s: dead letter kept its expiration %s", letter.Body, letter.Expiration)
+		}
+	}
+
+	if got := broker.QueueLength("long"); got != 1 {
+		t.Errorf("long has %d messages, want the one without a ttl", got)
+	}
+}
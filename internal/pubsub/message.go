@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message is a decoded delivery together with the metadata it arrived
+// with. Exchange and RoutingKey are where the message was first published,
+// even when it came back through a retry queue. Trace is the span of the
+// handler invocation; pass it to WithTraceParent to continue the trace.
+type Message[T any] struct {
+	Body T
+
+	Exchange      string
+	RoutingKey    string
+	Redelivered   bool
+	Timestamp     time.Time
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	AppID         string
+	ContentType   string
+	Priority      uint8
+	Headers       amqp.Table
+	Trace         SpanContext
+}
+
+// deliveryOrigin returns the exchange and routing key d was first
+// published to.
+func deliveryOrigin(d amqp.Delivery) (string, string) {
+	if exchange, ok := d.Headers[originalExchangeHeader].(string); ok {
+		key, _ := d.Headers[originalKeyHeader].(string)
+		return exchange, key
+	}
+
+	return d.Exchange, d.RoutingKey
+}
+
+func newMessage[T any](d amqp.Delivery, body T) Message[T] {
+	exchange, key := deliveryOrigin(d)
+
+	return Message[T]{
+		Body:          body,
+		Exchange:      exchange,
+		RoutingKey:    key,
+		Redelivered:   d.Redelivered,
+		Timestamp:     d.Timestamp,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		AppID:         d.AppId,
+		ContentType:   d.ContentType,
+		Priority:      d.Priority,
+		Headers:       d.Headers,
+	}
+}
+
+func bodyHandler[T any](handler func(T) AckType) func(Message[T]) AckType {
+	return func(msg Message[T]) AckType {
+		return handler(msg.Body)
+	}
+}
+
+// SubscribeMessage is like Subscribe but hands the handler the whole
+// Message instead of just its body. If codec is nil each delivery is
+// decoded with the codec registered for its ContentType.
+func SubscribeMessage[T any](
+	ctx context.Context,
+	conn *Connection,
+	codec Codec,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	handler func(Message[T]) AckType,
+	opts ...TypedSubscribeOption[T],
+) (*Subscription, error) {
+	return subscribe(
+		ctx,
+		conn,
+		exchange,
+		queueName,
+		key,
+		queueKind,
+		handler,
+		decoder[T](codec),
+		opts...,
+	)
+}
+
+// PublishOption sets properties on an outgoing message.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	amqp.Publishing
+	signer Signer
+}
+
+func WithMessageID(id string) PublishOption {
+	return func(p *publishOptions) {
+		p.MessageId = id
+	}
+}
+
+func WithCorrelationID(id string) PublishOption {
+	return func(p *publishOptions) {
+		p.CorrelationId = id
+	}
+}
+
+func WithTimestamp(t time.Time) PublishOption {
+	return func(p *publishOptions) {
+		p.Timestamp = t
+	}
+}
+
+func WithAppID(id string) PublishOption {
+	return func(p *publishOptions) {
+		p.AppId = id
+	}
+}
+
+// WithPriority sets the message priority. It only has an effect on queues
+// declared with a MaxPriority, and is capped at that.
+func WithPriority(priority uint8) PublishOption {
+	return func(p *publishOptions) {
+		p.Priority = priority
+	}
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return func(p *publishOptions) {
+		if p.Headers == nil {
+			p.Headers = amqp.Table{}
+		}
+		p.Headers[key] = value
+	}
+}
+
+// NewMessageID returns a random identifier suitable for WithMessageID.
+// Publishes without one get a fresh ID stamped automatically.
+func NewMessageID() string {
+	return newID()
+}
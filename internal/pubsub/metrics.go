@@ -0,0 +1,389 @@
+package pubsub
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the handler
+// latency histogram.
+var DefaultLatencyBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type metricKind string
+
+const (
+	counterKind   metricKind = "counter"
+	gaugeKind     metricKind = "gauge"
+	histogramKind metricKind = "histogram"
+)
+
+// Metrics is a set of counters, gauges and histograms that can be written
+// out in the Prometheus text format. Every Connection records its traffic
+// in one, see Connection.Metrics, and applications can add their own.
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Counter is a value that only goes up, with one series per combination of
+// label values.
+type Counter struct {
+	m *Metrics
+	f *metricFamily
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	m *Metrics
+	f *metricFamily
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	m *Metrics
+	f *metricFamily
+}
+
+func (m *Metrics) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{m: m, f: m.register(name, help, counterKind, labels, nil)}
+}
+
+func (m *Metrics) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{m: m, f: m.register(name, help, gaugeKind, labels, nil)}
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds.
+// An implicit +Inf bucket is always added.
+func (m *Metrics) NewHistogram(
+	name, help string,
+	buckets []float64,
+	labels ...string,
+) *Histogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	return &Histogram{m: m, f: m.register(name, help, histogramKind, labels, buckets)}
+}
+
+func (m *Metrics) register(
+	name, help string,
+	kind metricKind,
+	labels []string,
+	buckets []float64,
+) *metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, f := range m.families {
+		if f.name == name {
+			panic(fmt.Sprintf("pubsub: metric '%s' registered twice", name))
+		}
+	}
+
+	f := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	m.families = append(m.families, f)
+
+	return f
+}
+
+// get returns the series for labelValues, creating it on first use. The
+// caller holds m.mu.
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf(
+			"pubsub: metric '%s' takes %d label values, got %d",
+			f.name,
+			len(f.labels),
+			len(labelValues),
+		))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("pubsub: counter '%s' cannot decrease", c.f.name))
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	c.f.get(labelValues).value += v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+
+	g.f.get(labelValues).value += v
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+
+	g.f.get(labelValues).value = v
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogramKind {
+				writeSample(&b, f.name, f.labels, s.labelValues, "", "", s.value)
+				continue
+			}
+
+			for i, bound := range f.buckets {
+				writeSample(
+					&b,
+					f.name+"_bucket",
+					f.labels,
+					s.labelValues,
+					"le",
+					formatFloat(bound),
+					float64(s.counts[i]),
+				)
+			}
+			writeSample(&b, f.name+"_bucket", f.labels, s.labelValues, "le", "+Inf", float64(s.count))
+			writeSample(&b, f.name+"_sum", f.labels, s.labelValues, "", "", s.value)
+			writeSample(&b, f.name+"_count", f.labels, s.labelValues, "", "", float64(s.count))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	m.WriteTo(w)
+}
+
+// ServeMetrics serves m on /metrics at addr. It blocks like
+// http.ListenAndServe.
+func ServeMetrics(addr string, m *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	return http.ListenAndServe(addr, mux)
+}
+
+func writeSample(
+	b *strings.Builder,
+	name string,
+	labels, labelValues []string,
+	extraLabel, extraValue string,
+	value float64,
+) {
+	b.WriteString(name)
+
+	pairs := []string{}
+	for i, label := range labels {
+		pairs = append(pairs, label+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if extraLabel != "" {
+		pairs = append(pairs, extraLabel+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	b.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// connMetrics are the metrics a Connection records about its own traffic.
+type connMetrics struct {
+	published       *Counter
+	publishFailures *Counter
+	consumed        *Counter
+	acked           *Counter
+	nacked          *Counter
+	retried         *Counter
+	decodeFailures  *Counter
+	handlerDuration *Histogram
+	inFlight        *Gauge
+}
+
+func newConnMetrics(m *Metrics) *connMetrics {
+	return &connMetrics{
+		published: m.NewCounter(
+			"pubsub_published_total",
+			"Messages handed to the broker.",
+			"exchange", "routing_key",
+		),
+		publishFailures: m.NewCounter(
+			"pubsub_publish_failures_total",
+			"Publishes that returned an error.",
+			"exchange", "routing_key",
+		),
+		consumed: m.NewCounter(
+			"pubsub_consumed_total",
+			"Deliveries received by subscriptions.",
+			"queue", "exchange", "routing_key",
+		),
+		acked: m.NewCounter(
+			"pubsub_acked_total",
+			"Deliveries acknowledged.",
+			"queue", "exchange", "routing_key",
+		),
+		nacked: m.NewCounter(
+			"pubsub_nacked_total",
+			"Deliveries negatively acknowledged.",
+			"queue", "exchange", "routing_key", "requeue",
+		),
+		retried: m.NewCounter(
+			"pubsub_retried_total",
+			"Deliveries handed back with RetryLater.",
+			"queue", "exchange", "routing_key",
+		),
+		decodeFailures: m.NewCounter(
+			"pubsub_decode_failures_total",
+			"Deliveries that could not be decoded or verified.",
+			"queue", "exchange", "routing_key",
+		),
+		handlerDuration: m.NewHistogram(
+			"pubsub_handler_duration_seconds",
+			"Time spent in handlers. Batch handlers are timed per batch.",
+			DefaultLatencyBuckets,
+			"queue",
+		),
+		inFlight: m.NewGauge(
+			"pubsub_in_flight_messages",
+			"Messages currently being handled.",
+			"queue",
+		),
+	}
+}
+
+func (m *connMetrics) publish(exchange, key string, err error) {
+	// Every direct reply-to address is unique, so they share one series.
+	if exchange == "" && strings.HasPrefix(key, directReplyTo) {
+		key = directReplyTo
+	}
+
+	if err != nil {
+		m.publishFailures.Inc(exchange, key)
+		return
+	}
+	m.published.Inc(exchange, key)
+}
+
+func (m *connMetrics) settled(queueName string, d amqp.Delivery, ackType AckType) {
+	exchange, key := deliveryOrigin(d)
+	switch ackType {
+	case Ack:
+		m.acked.Inc(queueName, exchange, key)
+	case NackRequeue:
+		m.nacked.Inc(queueName, exchange, key, "true")
+	case NackDiscard:
+		m.nacked.Inc(queueName, exchange, key, "false")
+	case RetryLater:
+		m.retried.Inc(queueName, exchange, key)
+	}
+}
@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	m := NewMetrics()
+	moves := m.NewCounter("moves_total", "Moves made.\nBy anyone.", "player")
+	players := m.NewGauge("players", "Players online.")
+	latency := m.NewHistogram("latency_seconds", "Handler latency.", []float64{1, 0.1}, "queue")
+
+	moves.Inc(`bob`)
+	moves.Add(2, `alice "the \ great"`)
+	players.Set(3)
+	players.Add(-1)
+	latency.Observe(0.05, "moves")
+	latency.Observe(0.5, "moves")
+	latency.Observe(5, "moves")
+
+	var out strings.Builder
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Series are sorted by label values and buckets by their bound.
+	want := `# HELP moves_total Moves made.\nBy anyone.
+# TYPE moves_total counter
+moves_total{player="alice \"the \\ great\""} 2
+moves_total{player="bob"} 1
+# HELP players Players online.
+# TYPE players gauge
+players 2
+# HELP latency_seconds Handler latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{queue="moves",le="0.1"} 1
+latency_seconds_bucket{queue="moves",le="1"} 2
+latency_seconds_bucket{queue="moves",le="+Inf"} 3
+latency_seconds_sum{queue="moves"} 5.55
+latency_seconds_count{queue="moves"} 3
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.NewCounter("wars_total", "Wars fought.").Inc()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := rec.Header().Get("Content-Type"); got != metricsContentType {
+		t.Errorf("content type %q, want %q", got, metricsContentType)
+	}
+	if !strings.Contains(rec.Body.String(), "wars_total 1\n") {
+		t.Errorf("body does not contain the counter:\n%s", rec.Body.String())
+	}
+}
+
+func TestMetricsRejectMisuse(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(m *Metrics)
+	}{
+		{"registered twice", func(m *Metrics) {
+			m.NewCounter("moves_total", "")
+			m.NewGauge("moves_total", "")
+		}},
+		{"wrong label count", func(m *Metrics) {
+			m.NewCounter("moves_total", "", "player").Inc()
+		}},
+		{"decreasing counter", func(m *Metrics) {
+			m.NewCounter("moves_total", "").Add(-1)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("did not panic")
+				}
+			}()
+			tt.f(NewMetrics())
+		})
+	}
+}
+
+func TestConnectionMetricsCountTraffic(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan Message[string], 2)
+	subscribeTestQueue(t, conn, "moves", func(msg Message[string]) AckType {
+		received <- msg
+		if msg.Body == "bad" {
+			return NackDiscard
+		}
+		return Ack
+	})
+
+	for _, body := range []string{"good", "bad"} {
+		if err := PublishJSON(conn, testExchange, "moves", body); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, received)
+	}
+
+	for _, want := range []string{
+		`pubsub_published_total{exchange="test_topic",routing_key="moves"} 2`,
+		`pubsub_acked_total{queue="moves",exchange="test_topic",routing_key="moves"} 1`,
+		`pubsub_nacked_total{queue="moves",exchange="test_topic",routing_key="moves",requeue="false"} 1`,
+	} {
+		eventually(t, func() bool {
+			var out strings.Builder
+			if _, err := conn.Metrics().WriteTo(&out); err != nil {
+				t.Fatal(err)
+			}
+			return strings.Contains(out.String(), want)
+		})
+	}
+}
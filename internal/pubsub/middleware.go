@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+type Handler[T any] func(Message[T]) AckType
+
+// Middleware wraps a handler with behaviour that runs around every
+// delivery.
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain wraps handler in mws. The first middleware is the outermost one.
+func Chain[T any](handler Handler[T], mws ...Middleware[T]) Handler[T] {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+
+	return handler
+}
+
+// WithMiddleware wraps the subscription's handler in mws, the first one
+// outermost, as Chain does.
+func WithMiddleware[T any](mws ...Middleware[T]) TypedSubscribeOption[T] {
+	return func(o *subscribeOptions) {
+		typed := typedOptionsOf[T](o)
+		typed.middlewares = append(typed.middlewares, mws...)
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard and logs the panic
+// with its stack trace.
+func Recover[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) (ackType AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf(
+						"handler panicked on '%s': %v\n%s",
+						msg.RoutingKey,
+						r,
+						debug.Stack(),
+					)
+					ackType = NackDiscard
+				}
+			}()
+
+			return next(msg)
+		}
+	}
+}
+
+// Timing calls observe with how long the handler took for every message.
+func Timing[T any](observe func(Message[T], AckType, time.Duration)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(msg Message[T]) AckType {
+			start := time.Now()
+			ackType := next(msg)
+			observe(msg, ackType, time.Since(start))
+
+			return ackType
+		}
+	}
+}
+
+// Logging writes one structured log record per handled message.
+func Logging[T any](logger *slog.Logger) Middleware[T] {
+	return Timing(func(msg Message[T], ackType AckType, took time.Duration) {
+		logger.Info(
+			"handled message",
+			"exchange", msg.Exchange,
+			"routing_key", msg.RoutingKey,
+			"message_id", msg.MessageID,
+			"redelivered", msg.Redelivered,
+			"ack", ackType,
+			"duration", took,
+		)
+	})
+}
+
+// BatchMiddleware wraps a batch handler with behaviour that runs around
+// every batch.
+type BatchMiddleware[T any] func(BatchHandler[T]) BatchHandler[T]
+
+// ChainBatch wraps handler in mws. The first middleware is the outermost
+// one. Pass the result as the handler of SubscribeBatch.
+func ChainBatch[T any](handler BatchHandler[T], mws ...BatchMiddleware[T]) BatchHandler[T] {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+
+	return handler
+}
+
+// LoggingBatch writes one structured log record per message of every
+// handled batch, with the time the whole batch took.
+func LoggingBatch[T any](logger *slog.Logger) BatchMiddleware[T] {
+	return func(next BatchHandler[T]) BatchHandler[T] {
+		return func(msgs []Message[T]) []AckType {
+			start := time.Now()
+			ackTypes := next(msgs)
+			took := time.Since(start)
+
+			for i, msg := range msgs {
+				logger.Info(
+					"handled message",
+					"exchange", msg.Exchange,
+					"routing_key", msg.RoutingKey,
+					"message_id", msg.MessageID,
+					"redelivered", msg.Redelivered,
+					"ack", batchAckType(ackTypes, len(msgs), i),
+					"batch_size", len(msgs),
+					"duration", took,
+				)
+			}
+
+			return ackTypes
+		}
+	}
+}
+
+// RecoverBatch turns a panicking batch handler into RetryLater for the
+// whole batch and logs the panic with its stack trace, so a bad message
+// ends up in the dead-letter queue once its retries run out.
+func RecoverBatch[T any]() BatchMiddleware[T] {
+	return func(next BatchHandler[T]) BatchHandler[T] {
+		return func(msgs []Message[T]) (ackTypes []AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf(
+						"batch handler panicked on a batch of %d messages: %v\n%s",
+						len(msgs),
+						r,
+						debug.Stack(),
+					)
+					ackTypes = SettleAll(RetryLater)
+				}
+			}()
+
+			return next(msgs)
+		}
+	}
+}
+
+// batchAckType is how the i-th of n messages is settled given the AckTypes
+// a batch handler returned.
+func batchAckType(ackTypes []AckType, n, i int) AckType {
+	switch len(ackTypes) {
+	case 1:
+		return ackTypes[0]
+	case n:
+		return ackTypes[i]
+	default:
+		return NackRequeue
+	}
+}
@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWithMiddlewareWrapsTheHandlerInOrder(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	handled := make(chan struct{}, 1)
+	order := []string{}
+	trace := func(name string) Middleware[string] {
+		return func(next Handler[string]) Handler[string] {
+			return func(msg Message[string]) AckType {
+				order = append(order, name)
+				return next(msg)
+			}
+		}
+	}
+	subscribeTestQueue(
+		t,
+		conn,
+		"moves",
+		func(msg Message[string]) AckType {
+			order = append(order, "handler")
+			handled <- struct{}{}
+			return Ack
+		},
+		WithMiddleware(trace("outer"), trace("inner")),
+	)
+
+	if err := PublishJSON(conn, testExchange, "moves", "attack"); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	if want := []string{"outer", "inner", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+}
+
+func TestRecoverDeadLettersPanickingMessages(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	handled := make(chan string, 1)
+	subscribeTestQueue(
+		t,
+		conn,
+		"moves",
+		func(msg Message[string]) AckType {
+			if msg.Body == "bad" {
+				panic("bad move")
+			}
+			handled <- msg.Body
+			return Ack
+		},
+		WithMiddleware(Recover[string]()),
+	)
+
+	for _, body := range []string{"bad", "good"} {
+		if err := PublishJSON(conn, testExchange, "moves", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The consumer survives the panic and moves on.
+	if got := receive(t, handled); got != "good" {
+		t.Errorf("got %q", got)
+	}
+	eventually(t, func() bool {
+		return broker.QueueLength(DeadLetterQueue) == 1
+	})
+}
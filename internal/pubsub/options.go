@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubscribeOption configures a subscription to messages of any type.
+type SubscribeOption = func(*subscribeOptions)
+
+// TypedSubscribeOption configures a subscription to messages of type T,
+// such as WithMiddleware. Every SubscribeOption is also one, so the two
+// mix in a single call, and the compiler rejects options for another type.
+type TypedSubscribeOption[T any] func(*subscribeOptions)
+
+type subscribeOptions struct {
+	retry         *RetryPolicy
+	decodeFailure DecodeFailurePolicy
+	onDecodeError func(amqp.Delivery, error) AckType
+	prefetch      int
+	concurrency   int
+	orderingKey   func(amqp.Delivery) string
+	batchSize     int
+	batchWindow   time.Duration
+	stream        *streamCursor
+	keys          *KeyRegistry
+	// typed is the *typedOptions[T] of the subscription being set up.
+	typed any
+}
+
+// typedOptions are the options that depend on the subscription's message
+// type.
+type typedOptions[T any] struct {
+	middlewares []Middleware[T]
+	claimed     func(Message[T]) []string
+}
+
+func newSubscribeOptions[T any](opts []TypedSubscribeOption[T]) (subscribeOptions, *typedOptions[T]) {
+	typed := &typedOptions[T]{}
+	options := subscribeOptions{typed: typed}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options, typed
+}
+
+// typedOptionsOf returns the typed options of o. A TypedSubscribeOption[T]
+// only compiles as an option of a subscription to T, so they always have
+// type T.
+func typedOptionsOf[T any](o *subscribeOptions) *typedOptions[T] {
+	return o.typed.(*typedOptions[T])
+}
+
+// WithRetry declares delayed retry queues for the subscription so that
+// handlers can return RetryLater.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
@@ -0,0 +1,527 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	minOutboxRetryDelay = time.Second
+	maxOutboxRetryDelay = 30 * time.Second
+)
+
+// Outbox lets handlers queue outgoing messages in a local append-only log
+// instead of publishing them directly. Once Enqueue returns the message is
+// on disk, so the inbound delivery can be acked even if the broker is
+// unreachable. A relay goroutine publishes queued messages in order with
+// publisher confirms and marks each one done once the broker has it.
+type Outbox struct {
+	publisher *ConfirmPublisher
+
+	mu      sync.Mutex
+	file    *os.File
+	pending []outboxRecord
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// outboxRecord is one line of the outbox log. A message is written once
+// with Done unset, and again with only its ID and Done set once it has
+// been published.
+type outboxRecord struct {
+	ID   string `json:"id"`
+	Done bool   `json:"done,omitempty"`
+
+	Exchange        string        `json:"exchange,omitempty"`
+	Key             string        `json:"key,omitempty"`
+	ContentType     string        `json:"content_type,omitempty"`
+	ContentEncoding string        `json:"content_encoding,omitempty"`
+	Headers         outboxHeaders `json:"headers,omitempty"`
+	MessageID       string        `json:"message_id,omitempty"`
+	CorrelationID   string        `json:"correlation_id,omitempty"`
+	Timestamp       time.Time     `json:"timestamp,omitempty"`
+	AppID           string        `json:"app_id,omitempty"`
+	Priority        uint8         `json:"priority,omitempty"`
+	Body            []byte        `json:"body,omitempty"`
+}
+
+func (r outboxRecord) publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         amqp.Table(r.Headers),
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		MessageId:       r.MessageID,
+		CorrelationId:   r.CorrelationID,
+		Timestamp:       r.Timestamp,
+		AppId:           r.AppID,
+		Priority:        r.Priority,
+		Body:            r.Body,
+	}
+}
+
+// OpenOutbox opens or creates the outbox log at path, queues every message
+// in it that was never marked done and starts relaying them through
+// publisher.
+func OpenOutbox(path string, publisher *ConfirmPublisher) (*Outbox, error) {
+	pending, err := loadOutbox(path)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		publisher: publisher,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if o.file, err = rewriteOutbox(path, pending); err != nil {
+		return nil, err
+	}
+	o.pending = pending
+
+	o.wg.Add(1)
+	go o.relay()
+	o.notify()
+
+	return o, nil
+}
+
+func (o *Outbox) EnqueueRaw(exchange, key string, msg amqp.Publishing) error {
+	record := outboxRecord{
+		ID:              newID(),
+		Exchange:        exchange,
+		Key:             key,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Headers:         outboxHeaders(msg.Headers),
+		MessageID:       msg.MessageId,
+		CorrelationID:   msg.CorrelationId,
+		Timestamp:       msg.Timestamp,
+		AppID:           msg.AppId,
+		Priority:        msg.Priority,
+		Body:            msg.Body,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.append(record); err != nil {
+		return err
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync outbox: %v", err)
+	}
+	o.pending = append(o.pending, record)
+	o.notify()
+
+	return nil
+}
+
+func (o *Outbox) Enqueue(
+	codec Codec,
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	msg, err := marshal(codec, key, val, opts)
+	if err != nil {
+		return err
+	}
+
+	return o.EnqueueRaw(exchange, key, msg)
+}
+
+func (o *Outbox) EnqueueJSON(
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	return o.Enqueue(JSON, exchange, key, val, opts...)
+}
+
+func (o *Outbox) EnqueueGob(
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	return o.Enqueue(Gob, exchange, key, val, opts...)
+}
+
+// Close stops the relay. Messages that have not been published yet stay
+// in the log and are relayed the next time it is opened.
+func (o *Outbox) Close() error {
+	close(o.done)
+	o.wg.Wait()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file.Close()
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) relay() {
+	defer o.wg.Done()
+
+	delay := minOutboxRetryDelay
+	for {
+		o.mu.Lock()
+		var next outboxRecord
+		ok := len(o.pending) > 0
+		if ok {
+			next = o.pending[0]
+		}
+		o.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-o.done:
+				return
+			case <-o.wake:
+				continue
+			}
+		}
+
+		err := o.publisher.PublishAndWait(
+			context.Background(),
+			next.Exchange,
+			next.Key,
+			next.publishing(),
+		)
+		if err != nil {
+			log.Printf("could not relay outbox message: %s", err)
+			select {
+			case <-o.done:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxOutboxRetryDelay)
+			continue
+		}
+		delay = minOutboxRetryDelay
+
+		if err = o.markDone(next.ID); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (o *Outbox) markDone(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = o.pending[1:]
+	if len(o.pending) == 0 {
+		// Nothing is left to relay, so the whole log can go.
+		if err := o.file.Truncate(0); err != nil {
+			return fmt.Errorf("could not truncate outbox: %v", err)
+		}
+		return nil
+	}
+
+	return o.append(outboxRecord{ID: id, Done: true})
+}
+
+func (o *Outbox) append(record outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write outbox: %v", err)
+	}
+
+	return nil
+}
+
+func loadOutbox(path string) ([]outboxRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %v", err)
+	}
+	defer file.Close()
+
+	records := []outboxRecord{}
+	done := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record outboxRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn write from a crash can only be the last line.
+			log.Printf("skipping corrupt outbox record: %s", err)
+			continue
+		}
+
+		if record.Done {
+			done[record.ID] = true
+		} else {
+			records = append(records, record)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read outbox: %v", err)
+	}
+
+	pending := []outboxRecord{}
+	for _, record := range records {
+		if !done[record.ID] {
+			pending = append(pending, record)
+		}
+	}
+
+	return pending, nil
+}
+
+// rewriteOutbox compacts the log down to the pending records and returns
+// it opened for appending.
+func rewriteOutbox(path string, pending []outboxRecord) (*os.File, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("could not rewrite outbox: %v", err)
+	}
+
+	w := bufio.NewWriter(file)
+	for _, record := range pending {
+		line, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not rewrite outbox: %v", err)
+	}
+	file.Close()
+
+	if err = os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("could not rewrite outbox: %v", err)
+	}
+
+	file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %v", err)
+	}
+
+	return file, nil
+}
+
+// outboxHeaders stores every header value together with its type. Plain
+// JSON would turn the int32 schema version and retry count into float64,
+// which subscribers no longer recognise.
+type outboxHeaders amqp.Table
+
+type typedHeader struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (h outboxHeaders) MarshalJSON() ([]byte, error) {
+	fields, err := encodeHeaderTable(amqp.Table(h))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+func (h *outboxHeaders) UnmarshalJSON(data []byte) error {
+	fields := map[string]typedHeader{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	table, err := decodeHeaderTable(fields)
+	if err != nil {
+		return err
+	}
+	*h = outboxHeaders(table)
+
+	return nil
+}
+
+func encodeHeaderTable(table amqp.Table) (map[string]typedHeader, error) {
+	fields := make(map[string]typedHeader, len(table))
+	for key, value := range table {
+		field, err := encodeHeader(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %w", key, err)
+		}
+		fields[key] = field
+	}
+
+	return fields, nil
+}
+
+func encodeHeader(value any) (typedHeader, error) {
+	var kind string
+	switch v := value.(type) {
+	case nil:
+		return typedHeader{Type: "nil"}, nil
+	case amqp.Table:
+		fields, err := encodeHeaderTable(v)
+		if err != nil {
+			return typedHeader{}, err
+		}
+		return typedHeaderOf("table", fields)
+	case []interface{}:
+		items := make([]typedHeader, 0, len(v))
+		for _, item := range v {
+			encoded, err := encodeHeader(item)
+			if err != nil {
+				return typedHeader{}, err
+			}
+			items = append(items, encoded)
+		}
+		return typedHeaderOf("array", items)
+	case bool:
+		kind = "bool"
+	case byte:
+		kind = "uint8"
+	case int8:
+		kind = "int8"
+	case int16:
+		kind = "int16"
+	case uint16:
+		kind = "uint16"
+	case int32:
+		kind = "int32"
+	case uint32:
+		kind = "uint32"
+	case int:
+		kind = "int"
+	case int64:
+		kind = "int64"
+	case float32:
+		kind = "float32"
+	case float64:
+		kind = "float64"
+	case string:
+		kind = "string"
+	case []byte:
+		kind = "bytes"
+	case time.Time:
+		kind = "time"
+	case amqp.Decimal:
+		kind = "decimal"
+	default:
+		return typedHeader{}, fmt.Errorf("unsupported header type %T", value)
+	}
+
+	return typedHeaderOf(kind, value)
+}
+
+func typedHeaderOf(kind string, value any) (typedHeader, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return typedHeader{}, err
+	}
+
+	return typedHeader{Type: kind, Value: raw}, nil
+}
+
+func decodeHeaderTable(fields map[string]typedHeader) (amqp.Table, error) {
+	table := make(amqp.Table, len(fields))
+	for key, field := range fields {
+		value, err := decodeHeader(field)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s': %w", key, err)
+		}
+		table[key] = value
+	}
+
+	return table, nil
+}
+
+func decodeHeader(field typedHeader) (any, error) {
+	switch field.Type {
+	case "nil":
+		return nil, nil
+	case "table":
+		fields := map[string]typedHeader{}
+		if err := json.Unmarshal(field.Value, &fields); err != nil {
+			return nil, err
+		}
+		return decodeHeaderTable(fields)
+	case "array":
+		items := []typedHeader{}
+		if err := json.Unmarshal(field.Value, &items); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			value, err := decodeHeader(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case "bool":
+		return decodeHeaderAs[bool](field.Value)
+	case "uint8":
+		return decodeHeaderAs[byte](field.Value)
+	case "int8":
+		return decodeHeaderAs[int8](field.Value)
+	case "int16":
+		return decodeHeaderAs[int16](field.Value)
+	case "uint16":
+		return decodeHeaderAs[uint16](field.Value)
+	case "int32":
+		return decodeHeaderAs[int32](field.Value)
+	case "uint32":
+		return decodeHeaderAs[uint32](field.Value)
+	case "int":
+		return decodeHeaderAs[int](field.Value)
+	case "int64":
+		return decodeHeaderAs[int64](field.Value)
+	case "float32":
+		return decodeHeaderAs[float32](field.Value)
+	case "float64":
+		return decodeHeaderAs[float64](field.Value)
+	case "string":
+		return decodeHeaderAs[string](field.Value)
+	case "bytes":
+		return decodeHeaderAs[[]byte](field.Value)
+	case "time":
+		return decodeHeaderAs[time.Time](field.Value)
+	case "decimal":
+		return decodeHeaderAs[amqp.Decimal](field.Value)
+	default:
+		return nil, fmt.Errorf("unknown header type '%s'", field.Type)
+	}
+}
+
+func decodeHeaderAs[V any](raw json.RawMessage) (any, error) {
+	var v V
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestOutboxHeadersKeepTheirTypes(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	headers := amqp.Table{
+		schemaVersionHeader: int32(2),
+		retryAttemptsHeader: int32(3),
+		"x-string":          "value",
+		"x-int64":           int64(1 << 40),
+		"x-time":            now,
+		"x-bytes":           []byte{1, 2, 3},
+		"x-table":           amqp.Table{"nested": []interface{}{int16(7), "b"}},
+	}
+
+	data, err := json.Marshal(outboxRecord{ID: "1", Headers: outboxHeaders(headers)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record outboxRecord
+	if err = json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+
+	got := record.publishing().Headers
+	if v, ok := got[schemaVersionHeader].(int32); !ok || v != 2 {
+		t.Errorf("schema version = %#v, want int32(2)", got[schemaVersionHeader])
+	}
+	if v, ok := got[retryAttemptsHeader].(int32); !ok || v != 3 {
+		t.Errorf("retry attempts = %#v, want int32(3)", got[retryAttemptsHeader])
+	}
+	if v, ok := got["x-int64"].(int64); !ok || v != 1<<40 {
+		t.Errorf("x-int64 = %#v", got["x-int64"])
+	}
+	if v, ok := got["x-time"].(time.Time); !ok || !v.Equal(now) {
+		t.Errorf("x-time = %#v, want %s", got["x-time"], now)
+	}
+	if v, ok := got["x-bytes"].([]byte); !ok || string(v) != "\x01\x02\x03" {
+		t.Errorf("x-bytes = %#v", got["x-bytes"])
+	}
+	nested, _ := got["x-table"].(amqp.Table)["nested"].([]interface{})
+	if len(nested) != 2 || nested[0] != int16(7) || nested[1] != "b" {
+		t.Errorf("x-table = %#v", got["x-table"])
+	}
+}
+
+func TestOutboxRelaysPendingMessagesAfterReopen(t *testing.T) {
+	type event struct {
+		Name string
+	}
+
+	path := filepath.Join(t.TempDir(), "test.outbox")
+
+	// Nothing is listening yet, so the message stays pending in the log.
+	down := NewMemoryBroker()
+	conn, err := Connect(down.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewConfirmPublisher(conn, time.Second)
+	conn.Close()
+
+	outbox, err := OpenOutbox(path, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.EnqueueJSON(testExchange, "events", event{Name: "war"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = outbox.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	broker := NewMemoryBroker()
+	conn = newTestConnection(t, broker)
+	received := make(chan Message[event], 1)
+	subscribeTestQueue(t, conn, "events", func(msg Message[event]) AckType {
+		received <- msg
+		return Ack
+	})
+
+	outbox, err = OpenOutbox(path, NewConfirmPublisher(conn, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	msg := receive(t, received)
+	if msg.Body.Name != "war" {
+		t.Errorf("body = %+v", msg.Body)
+	}
+	if v, ok := msg.Headers[schemaVersionHeader].(int32); !ok || v != 1 {
+		t.Errorf("schema version = %#v, want int32(1)", msg.Headers[schemaVersionHeader])
+	}
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultPublisherChannels = 4
+
+// Publisher is safe for concurrent use. Every publish borrows one channel
+// from a fixed-size pool, so frames from different goroutines never
+// interleave on the same channel. Channels are opened lazily and replaced
+// once they are closed, for example after a reconnect.
+type Publisher struct {
+	conn *Connection
+	pool chan Channel
+}
+
+func NewPublisher(conn *Connection, channels int) *Publisher {
+	channels = max(channels, 1)
+	pool := make(chan Channel, channels)
+	for range channels {
+		pool <- nil
+	}
+
+	return &Publisher{
+		conn: conn,
+		pool: pool,
+	}
+}
+
+// PublishRaw sends msg as is.
+func (p *Publisher) PublishRaw(
+	ctx context.Context,
+	exchange, key string,
+	msg amqp.Publishing,
+) error {
+	var ch Channel
+	select {
+	case ch = <-p.pool:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		p.pool <- ch
+	}()
+
+	if ch == nil || ch.IsClosed() {
+		var err error
+		if ch, err = p.conn.Channel(); err != nil {
+			return err
+		}
+	}
+
+	span := startProducerSpan(exchange, key, &msg)
+	err := ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	span.finish(err)
+	p.conn.stats.publish(exchange, key, err)
+
+	return err
+}
+
+func (p *Publisher) Publish(
+	ctx context.Context,
+	codec Codec,
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	msg, err := marshal(codec, key, val, opts)
+	if err != nil {
+		return err
+	}
+
+	return p.PublishRaw(ctx, exchange, key, msg)
+}
+
+func (p *Publisher) PublishJSON(
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	return p.Publish(context.Background(), JSON, exchange, key, val, opts...)
+}
+
+func (p *Publisher) PublishGob(
+	exchange, key string,
+	val any,
+	opts ...PublishOption,
+) error {
+	return p.Publish(context.Background(), Gob, exchange, key, val, opts...)
+}
+
+// Close closes every pooled channel. Publishes already in progress finish
+// first.
+func (p *Publisher) Close() error {
+	var firstErr error
+	for range cap(p.pool) {
+		ch := <-p.pool
+		if ch == nil || ch.IsClosed() {
+			continue
+		}
+		if err := ch.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
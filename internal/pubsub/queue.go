@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueKind describes how a queue is declared. It is either one of the
+// SimpleQueueType shorthands or a QueueOptions.
+type QueueKind interface {
+	queueOptions() QueueOptions
+}
+
+func (t SimpleQueueType) queueOptions() QueueOptions {
+	switch t {
+	case DurableQueue:
+		return QueueOptions{Durable: true}
+	case TransientQueue:
+		return QueueOptions{AutoDelete: true, Exclusive: true}
+	default:
+		return QueueOptions{}
+	}
+}
+
+type QueueType string
+
+const (
+	ClassicQueue QueueType = "classic"
+	QuorumQueue  QueueType = "quorum"
+	// StreamQueue is an append-only log that consumers read from an offset
+	// with WithStreamOffset without removing anything.
+	StreamQueue QueueType = "stream"
+)
+
+// Overflow is what a queue does with new messages once it holds
+// MaxLength of them.
+type Overflow string
+
+const (
+	OverflowDropHead      Overflow = "drop-head"
+	OverflowRejectPublish Overflow = "reject-publish"
+)
+
+// QueueOptions spells out a queue declaration. Zero fields are left to the
+// broker's defaults. Like every queue pubsub declares, it dead-letters to
+// DeadLetterExchange, unless it is a stream.
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+
+	// Type is left to the broker's default when empty.
+	Type QueueType
+
+	MessageTTL time.Duration
+	MaxLength  int
+	Overflow   Overflow
+	// Expires deletes the queue once it has been unused this long.
+	Expires time.Duration
+	// Lazy keeps a classic queue's messages on disk.
+	Lazy bool
+	// MaxPriority makes a classic queue deliver messages with a higher
+	// priority first, for priorities up to MaxPriority.
+	MaxPriority uint8
+
+	// MaxLengthBytes and MaxAge bound how much history a stream keeps.
+	MaxLengthBytes int64
+	MaxAge         time.Duration
+
+	DeadLetterRoutingKey string
+	// DeliveryLimit dead-letters a message after it has been requeued this
+	// many times. Only quorum queues support it.
+	DeliveryLimit int
+
+	// Args holds any other x-arguments.
+	Args amqp.Table
+}
+
+func (o QueueOptions) queueOptions() QueueOptions {
+	return o
+}
+
+func (o QueueOptions) arguments() (amqp.Table, error) {
+	if o.Type == QuorumQueue || o.Type == StreamQueue {
+		if !o.Durable || o.AutoDelete || o.Exclusive {
+			return nil, fmt.Errorf("pubsub: %s queues must be durable and cannot be auto-delete or exclusive", o.Type)
+		}
+		if o.Lazy {
+			return nil, fmt.Errorf("pubsub: %s queues cannot be lazy", o.Type)
+		}
+	}
+	if o.MaxPriority > 0 && o.Type != "" && o.Type != ClassicQueue {
+		return nil, errors.New("pubsub: priorities are only supported by classic queues")
+	}
+	if o.DeliveryLimit > 0 && o.Type != QuorumQueue {
+		return nil, errors.New("pubsub: delivery limits are only supported by quorum queues")
+	}
+
+	// Streams never dead-letter.
+	args := amqp.Table{}
+	if o.Type != StreamQueue {
+		args["x-dead-letter-exchange"] = DeadLetterExchange
+	}
+	for k, v := range o.Args {
+		args[k] = v
+	}
+
+	if o.Type != "" {
+		args["x-queue-type"] = string(o.Type)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = string(o.Overflow)
+	}
+	if o.Expires > 0 {
+		args["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if o.MaxPriority > 0 {
+		args["x-max-priority"] = int64(o.MaxPriority)
+	}
+	if o.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = o.MaxLengthBytes
+	}
+	if o.MaxAge > 0 {
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(o.MaxAge.Seconds()))
+	}
+	if o.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = o.DeadLetterRoutingKey
+	}
+	if o.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(o.DeliveryLimit)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,118 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	retryAttemptsHeader    = "x-retry-attempts"
+	originalExchangeHeader = "x-original-exchange"
+	originalKeyHeader      = "x-original-routing-key"
+)
+
+// RetryPolicy describes how a message handed back with RetryLater is
+// delayed before it is delivered again. The n-th retry waits Delays[n-1],
+// or the last delay once the list runs out. After MaxAttempts retries the
+// message is dead-lettered.
+type RetryPolicy struct {
+	Delays      []time.Duration
+	MaxAttempts int
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Delays:      []time.Duration{time.Second, 10 * time.Second, time.Minute},
+	MaxAttempts: 3,
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	return p.Delays[min(attempt, len(p.Delays))-1]
+}
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queueName, delay)
+}
+
+// declareRetryQueues declares one queue per delay. Messages sit there
+// until their TTL expires and are then dead-lettered through the default
+// exchange straight back into queueName. The retry queues never expire on
+// their own: they are durable if queueName is, and exclusive to the same
+// connection if queueName is, so they go away together.
+func declareRetryQueues(
+	ch Channel,
+	queueName string,
+	queueKind QueueKind,
+	policy RetryPolicy,
+) error {
+	if len(policy.Delays) == 0 {
+		return fmt.Errorf("retry policy for '%s' has no delays", queueName)
+	}
+
+	options := queueKind.queueOptions()
+	for _, delay := range policy.Delays {
+		if _, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay),
+			options.Durable,
+			false,
+			options.Exclusive,
+			false,
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retry parks d in the retry queue matching its attempt count, or
+// dead-letters it once the policy is exhausted. d is only acked once the
+// broker has confirmed the copy reached the retry queue, and requeued if
+// it did not.
+func (c *consumer) retry(d amqp.Delivery) error {
+	if c.options.retry == nil {
+		log.Printf("no retry policy for '%s', dead-lettering message", c.queueName)
+		return d.Nack(false, false)
+	}
+
+	attempt := retryAttempts(d.Headers) + 1
+	if attempt > c.options.retry.MaxAttempts {
+		return d.Nack(false, false)
+	}
+
+	msg := republishing(d)
+	msg.Headers[retryAttemptsHeader] = int32(attempt)
+
+	if err := c.publisher.PublishMandatory(
+		context.Background(),
+		"",
+		retryQueueName(c.queueName, c.options.retry.delay(attempt)),
+		msg,
+	); err != nil {
+		log.Printf("could not schedule retry: %s", err)
+		return d.Nack(false, true)
+	}
+
+	return d.Ack(false)
+}
+
+func retryAttempts(headers amqp.Table) int {
+	switch n := headers[retryAttemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	default:
+		return 0
+	}
+}
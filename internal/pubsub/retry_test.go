@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testRetryPolicy = RetryPolicy{
+	Delays:      []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+	MaxAttempts: 2,
+}
+
+// queueArgs returns the arguments queue was declared with, and false if
+// there is no such queue.
+func queueArgs(broker *MemoryBroker, queue string) (amqp.Table, bool) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	q, ok := broker.queues[queue]
+	if !ok {
+		return nil, false
+	}
+
+	return q.args, true
+}
+
+func TestRetryLaterGoesThroughTheRetryQueues(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan Message[string], 3)
+	subscribeTestQueue(t, conn, "moves.alice", func(msg Message[string]) AckType {
+		received <- msg
+		return RetryLater
+	}, WithRetry(testRetryPolicy))
+
+	if err := PublishJSON(conn, testExchange, "moves.alice", "attack"); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := range 3 {
+		msg := receive(t, received)
+		if got := retryAttempts(msg.Headers); got != attempt {
+			t.Errorf("delivery %d has %d retry attempts", attempt+1, got)
+		}
+		// The origin survives the detour through the default exchange.
+		if msg.Exchange != testExchange || msg.RoutingKey != "moves.alice" {
+			t.Errorf("delivery %d came from %s/%s", attempt+1, msg.Exchange, msg.RoutingKey)
+		}
+	}
+
+	eventually(t, func() bool {
+		return broker.QueueLength(DeadLetterQueue) == 1
+	})
+	select {
+	case msg := <-received:
+		t.Errorf("got delivery %d past MaxAttempts", retryAttempts(msg.Headers)+1)
+	default:
+	}
+}
+
+func TestRetryQueuesLiveAsLongAsTheirQueue(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	if _, err := SubscribeMessage(
+		context.Background(),
+		conn,
+		nil,
+		testExchange,
+		"durable",
+		"durable",
+		DurableQueue,
+		func(msg Message[string]) AckType {
+			return Ack
+		},
+		WithRetry(testRetryPolicy),
+	); err != nil {
+		t.Fatal(err)
+	}
+	subscribeTestQueue(t, conn, "transient", func(msg Message[string]) AckType {
+		return Ack
+	}, WithRetry(testRetryPolicy))
+
+	for _, queue := range []string{"durable", "transient"} {
+		for _, delay := range testRetryPolicy.Delays {
+			name := retryQueueName(queue, delay)
+			args, ok := queueArgs(broker, name)
+			if !ok {
+				t.Fatalf("%s was not declared", name)
+			}
+			if _, ok = args["x-expires"]; ok {
+				t.Errorf("%s expires on its own", name)
+			}
+		}
+	}
+
+	conn.Close()
+
+	for _, delay := range testRetryPolicy.Delays {
+		if _, ok := queueArgs(broker, retryQueueName("durable", delay)); !ok {
+			t.Errorf("durable retry queue for %s went away with the connection", delay)
+		}
+		if _, ok := queueArgs(broker, retryQueueName("transient", delay)); ok {
+			t.Errorf("transient retry queue for %s outlived its connection", delay)
+		}
+	}
+}
+
+func TestRetryRequeuesWhenTheRetryQueueIsGone(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan Message[string], 2)
+	subscribeTestQueue(t, conn, "moves.alice", func(msg Message[string]) AckType {
+		received <- msg
+		if msg.Redelivered {
+			return Ack
+		}
+		return RetryLater
+	}, WithRetry(testRetryPolicy))
+
+	if err := withChannel(conn, func(ch Channel) error {
+		_, err := ch.QueueDelete(retryQueueName("moves.alice", testRetryPolicy.Delays[0]), false, false, false)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PublishJSON(conn, testExchange, "moves.alice", "attack"); err != nil {
+		t.Fatal(err)
+	}
+
+	receive(t, received)
+	msg := receive(t, received)
+	if !msg.Redelivered || retryAttempts(msg.Headers) != 0 {
+		t.Errorf("got redelivered = %t after %d retries, want the original requeued",
+			msg.Redelivered, retryAttempts(msg.Headers))
+	}
+}
@@ -0,0 +1,274 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	directReplyTo  = "amq.rabbitmq.reply-to"
+	rpcErrorHeader = "x-rpc-error"
+)
+
+var (
+	ErrRPCTimeout       = errors.New("pubsub: rpc call timed out")
+	ErrRPCChannelClosed = errors.New("pubsub: channel closed before rpc reply arrived")
+)
+
+// RPCError is returned by Call when the server's handler failed.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "pubsub: rpc failed: " + e.Message
+}
+
+// RPCClient sends requests and waits for their replies using RabbitMQ's
+// direct reply-to, so no reply queue has to be declared. Replies are
+// matched to calls by correlation ID.
+type RPCClient struct {
+	conn    *Connection
+	codec   Codec
+	timeout time.Duration
+
+	mu      sync.Mutex
+	ch      Channel
+	pending map[string]chan amqp.Delivery
+}
+
+func NewRPCClient(conn *Connection, codec Codec, timeout time.Duration) *RPCClient {
+	return &RPCClient{
+		conn:    conn,
+		codec:   codec,
+		timeout: timeout,
+	}
+}
+
+// Call publishes req to exchange with key and waits for the reply of the
+// matching Serve handler.
+func Call[Req, Resp any](
+	ctx context.Context,
+	client *RPCClient,
+	exchange, key string,
+	req Req,
+) (Resp, error) {
+	var resp Resp
+
+	msg, err := marshal(client.codec, key, req, nil)
+	if err != nil {
+		return resp, err
+	}
+
+	reply, err := client.call(ctx, exchange, key, msg)
+	if err != nil {
+		return resp, err
+	}
+
+	if reason, ok := reply.Headers[rpcErrorHeader].(string); ok {
+		return resp, &RPCError{Message: reason}
+	}
+
+	return decoder[Resp](nil)(reply)
+}
+
+func (c *RPCClient) call(
+	ctx context.Context,
+	exchange, key string,
+	msg amqp.Publishing,
+) (amqp.Delivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	id := newID()
+	replyCh := make(chan amqp.Delivery, 1)
+	msg.CorrelationId = id
+	msg.ReplyTo = directReplyTo
+	msg.Expiration = strconv.FormatInt(c.timeout.Milliseconds(), 10)
+
+	c.mu.Lock()
+	if c.ch == nil || c.ch.IsClosed() {
+		if err := c.openChannel(); err != nil {
+			c.mu.Unlock()
+			return amqp.Delivery{}, err
+		}
+	}
+	pending := c.pending
+	pending[id] = replyCh
+	span := startProducerSpan(exchange, key, &msg)
+	err := c.ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	c.mu.Unlock()
+	span.finish(err)
+	c.conn.stats.publish(exchange, key, err)
+
+	defer func() {
+		c.mu.Lock()
+		delete(pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case reply, ok := <-replyCh:
+		if !ok {
+			return amqp.Delivery{}, ErrRPCChannelClosed
+		}
+		return reply, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return amqp.Delivery{}, ErrRPCTimeout
+		}
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+// openChannel opens the channel calls are published on. Direct reply-to
+// only delivers replies to the channel that published the request, and
+// the reply consumer has to exist before the first publish.
+func (c *RPCClient) openChannel() error {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	replies, err := ch.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	pending := map[string]chan amqp.Delivery{}
+	go c.listen(replies, pending)
+
+	c.ch = ch
+	c.pending = pending
+
+	return nil
+}
+
+func (c *RPCClient) listen(
+	replies <-chan amqp.Delivery,
+	pending map[string]chan amqp.Delivery,
+) {
+	for reply := range replies {
+		c.mu.Lock()
+		replyCh, ok := pending[reply.CorrelationId]
+		delete(pending, reply.CorrelationId)
+		c.mu.Unlock()
+
+		if ok {
+			replyCh <- reply
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, replyCh := range pending {
+		close(replyCh)
+		delete(pending, id)
+	}
+}
+
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ch == nil {
+		return nil
+	}
+
+	return c.ch.Close()
+}
+
+// Serve answers the requests Call publishes to exchange with key. Requests
+// are decoded with codec, or by content type if codec is nil, and replies
+// are encoded the same way. An error or panic in handler is sent back to
+// the caller as an RPCError.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	conn *Connection,
+	codec Codec,
+	exchange, queueName, key string,
+	queueKind QueueKind,
+	handler func(Req) (Resp, error),
+	opts ...TypedSubscribeOption[Req],
+) (*Subscription, error) {
+	return SubscribeMessage(
+		ctx,
+		conn,
+		codec,
+		exchange,
+		queueName,
+		key,
+		queueKind,
+		func(msg Message[Req]) AckType {
+			if msg.ReplyTo == "" {
+				log.Printf("rpc request on '%s' has no reply-to", msg.RoutingKey)
+				return NackDiscard
+			}
+
+			reply, err := rpcReply(codec, msg, handler)
+			if err != nil {
+				reply = amqp.Publishing{
+					Headers: amqp.Table{rpcErrorHeader: err.Error()},
+				}
+			}
+			reply.CorrelationId = msg.CorrelationID
+			setTraceParent(&reply, msg.Trace)
+
+			if err = conn.publisher.PublishRaw(
+				context.Background(),
+				"",
+				msg.ReplyTo,
+				reply,
+			); err != nil {
+				log.Printf("could not send rpc reply: %s", err)
+			}
+
+			return Ack
+		},
+		opts...,
+	)
+}
+
+func rpcReply[Req, Resp any](
+	codec Codec,
+	msg Message[Req],
+	handler func(Req) (Resp, error),
+) (reply amqp.Publishing, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf(
+				"rpc handler panicked on '%s': %v\n%s",
+				msg.RoutingKey,
+				r,
+				debug.Stack(),
+			)
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	resp, err := handler(msg.Body)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	if codec == nil {
+		if codec, err = LookupCodec(msg.ContentType); err != nil {
+			return amqp.Publishing{}, err
+		}
+	}
+
+	return marshal(codec, msg.ReplyTo, resp, nil)
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testRequest struct {
+	N int
+}
+
+type testReply struct {
+	Doubled int
+}
+
+func serveTest(t *testing.T, conn *Connection, key string, handler func(testRequest) (testReply, error)) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if _, err := Serve(ctx, conn, JSON, testExchange, key, key, TransientQueue, handler); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallGetsTheReply(t *testing.T) {
+	conn := newTestConnection(t, NewMemoryBroker())
+	serveTest(t, conn, "double", func(req testRequest) (testReply, error) {
+		return testReply{Doubled: 2 * req.N}, nil
+	})
+
+	client := NewRPCClient(conn, JSON, 5*time.Second)
+	defer client.Close()
+
+	// Concurrent calls share the reply channel and are told apart by
+	// correlation ID.
+	errs := make(chan error, 10)
+	for n := range 10 {
+		go func() {
+			reply, err := Call[testRequest, testReply](
+				context.Background(),
+				client,
+				testExchange,
+				"double",
+				testRequest{N: n},
+			)
+			if err == nil && reply.Doubled != 2*n {
+				err = errors.New("reply does not match the request")
+			}
+			errs <- err
+		}()
+	}
+	for range 10 {
+		if err := receive(t, errs); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCallReturnsHandlerFailures(t *testing.T) {
+	conn := newTestConnection(t, NewMemoryBroker())
+	serveTest(t, conn, "fail", func(req testRequest) (testReply, error) {
+		if req.N < 0 {
+			panic("negative")
+		}
+		return testReply{}, errors.New("no playing state")
+	})
+
+	client := NewRPCClient(conn, JSON, 5*time.Second)
+	defer client.Close()
+
+	for _, n := range []int{1, -1} {
+		_, err := Call[testRequest, testReply](
+			context.Background(),
+			client,
+			testExchange,
+			"fail",
+			testRequest{N: n},
+		)
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Errorf("request %d: got %v, want an RPCError", n, err)
+		}
+	}
+}
+
+func TestCallTimesOutWithoutAServer(t *testing.T) {
+	conn := newTestConnection(t, NewMemoryBroker())
+	declareTestQueue(t, conn, "unserved", "unserved", DurableQueue)
+
+	client := NewRPCClient(conn, JSON, 20*time.Millisecond)
+	defer client.Close()
+
+	_, err := Call[testRequest, testReply](
+		context.Background(),
+		client,
+		testExchange,
+		"unserved",
+		testRequest{N: 1},
+	)
+	if !errors.Is(err, ErrRPCTimeout) {
+		t.Errorf("got %v, want %v", err, ErrRPCTimeout)
+	}
+}
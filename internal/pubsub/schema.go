@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const schemaVersionHeader = "x-schema-version"
+
+// ErrUnknownSchemaVersion is returned for messages in a schema version the
+// subscriber cannot decode. They are always dead-lettered.
+var ErrUnknownSchemaVersion = errors.New("pubsub: unknown schema version")
+
+// Messages published before versioning, and types that never had their
+// version set, are at version 1.
+const initialSchemaVersion = 1
+
+type schema struct {
+	version   int
+	upcasters map[int]func(Codec, []byte) (any, error)
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[reflect.Type]*schema{}
+)
+
+// SetSchemaVersion sets the current wire version of T. It is stamped on
+// every publish of T, and subscriptions decoding T reject newer versions
+// and upcast older ones.
+func SetSchemaVersion[T any](version int) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	schemaFor(reflect.TypeFor[T]()).version = version
+}
+
+// RegisterUpcaster migrates messages published as version of T, which
+// decode into Old, to the current T.
+func RegisterUpcaster[Old, T any](version int, upcast func(Old) T) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+
+	schemaFor(reflect.TypeFor[T]()).upcasters[version] = func(
+		codec Codec,
+		data []byte,
+	) (any, error) {
+		var old Old
+		if err := codec.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+
+		return upcast(old), nil
+	}
+}
+
+// schemaFor must be called with schemasMu held.
+func schemaFor(t reflect.Type) *schema {
+	s, ok := schemas[t]
+	if !ok {
+		s = &schema{
+			version:   initialSchemaVersion,
+			upcasters: map[int]func(Codec, []byte) (any, error){},
+		}
+		schemas[t] = s
+	}
+
+	return s
+}
+
+func schemaVersion(t reflect.Type) int {
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+
+	if s, ok := schemas[t]; ok {
+		return s.version
+	}
+
+	return initialSchemaVersion
+}
+
+func upcasterFor(t reflect.Type, version int) (func(Codec, []byte) (any, error), bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+
+	s, ok := schemas[t]
+	if !ok {
+		return nil, false
+	}
+	upcast, ok := s.upcasters[version]
+
+	return upcast, ok
+}
+
+// unmarshalVersioned decodes data into the current T, upcasting it first
+// if headers say it was published in an older version.
+func unmarshalVersioned[T any](codec Codec, headers amqp.Table, data []byte) (T, error) {
+	var body T
+	t := reflect.TypeFor[T]()
+	current := schemaVersion(t)
+
+	version := initialSchemaVersion
+	if v, ok := tableInt(headers, schemaVersionHeader); ok {
+		version = int(v)
+	}
+
+	if version == current {
+		err := codec.Unmarshal(data, &body)
+		return body, err
+	}
+	if version > current {
+		return body, fmt.Errorf(
+			"%w: %s version %d is newer than %d",
+			ErrUnknownSchemaVersion,
+			t,
+			version,
+			current,
+		)
+	}
+
+	upcast, ok := upcasterFor(t, version)
+	if !ok {
+		return body, fmt.Errorf(
+			"%w: no upcaster for %s version %d",
+			ErrUnknownSchemaVersion,
+			t,
+			version,
+		)
+	}
+
+	v, err := upcast(codec, data)
+	if err != nil {
+		return body, err
+	}
+
+	return v.(T), nil
+}
@@ -0,0 +1,161 @@
+package pubsub
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// order went from one unit in version 1 to several in version 2, and got a
+// priority in version 3.
+type orderV1 struct {
+	Unit string
+}
+
+type orderV2 struct {
+	Units []string
+}
+
+type order struct {
+	Units    []string
+	Priority int
+}
+
+func upcastOrderV2(old orderV2) order {
+	return order{Units: old.Units, Priority: 1}
+}
+
+// Version 1 goes through the version 2 upcaster, so each migration is only
+// written once.
+func upcastOrderV1(old orderV1) order {
+	return upcastOrderV2(orderV2{Units: []string{old.Unit}})
+}
+
+func init() {
+	SetSchemaVersion[orderV2](2)
+	SetSchemaVersion[order](3)
+	RegisterUpcaster(1, upcastOrderV1)
+	RegisterUpcaster(2, upcastOrderV2)
+}
+
+func TestUnmarshalVersionedUpcastsOlderVersions(t *testing.T) {
+	for _, codec := range []Codec{JSON, Gob} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			tests := []struct {
+				name    string
+				version any
+				val     any
+				want    order
+			}{
+				{"unversioned", nil, orderV1{Unit: "infantry"}, order{[]string{"infantry"}, 1}},
+				{"version 1", int32(1), orderV1{Unit: "infantry"}, order{[]string{"infantry"}, 1}},
+				{
+					"version 2",
+					int32(2),
+					orderV2{Units: []string{"artillery", "cavalry"}},
+					order{[]string{"artillery", "cavalry"}, 1},
+				},
+				{"current", int32(3), order{[]string{"cavalry"}, 5}, order{[]string{"cavalry"}, 5}},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					data, err := codec.Marshal(tt.val)
+					if err != nil {
+						t.Fatal(err)
+					}
+					headers := amqp.Table{}
+					if tt.version != nil {
+						headers[schemaVersionHeader] = tt.version
+					}
+
+					got, err := unmarshalVersioned[order](codec, headers, data)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("got %+v, want %+v", got, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestUnmarshalVersionedRejectsUnknownVersions(t *testing.T) {
+	data, err := JSON.Marshal(order{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 4 is from the future and orderV2 has no upcaster for its
+	// version 1.
+	if _, err := unmarshalVersioned[order](
+		JSON,
+		amqp.Table{schemaVersionHeader: int32(4)},
+		data,
+	); !errors.Is(err, ErrUnknownSchemaVersion) {
+		t.Errorf("version 4: got %v, want %v", err, ErrUnknownSchemaVersion)
+	}
+	if _, err := unmarshalVersioned[orderV2](
+		JSON,
+		amqp.Table{schemaVersionHeader: int32(1)},
+		data,
+	); !errors.Is(err, ErrUnknownSchemaVersion) {
+		t.Errorf("orderV2 version 1: got %v, want %v", err, ErrUnknownSchemaVersion)
+	}
+}
+
+func TestSubscriberUpcastsAndDeadLettersFutureVersions(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	received := make(chan order, 3)
+	subscribeTestQueue(t, conn, "orders", func(msg Message[order]) AckType {
+		received <- msg.Body
+		return Ack
+	})
+
+	// Publishing stamps the version of the type that is published.
+	if err := PublishJSON(conn, testExchange, "orders", orderV1{Unit: "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(
+		conn,
+		testExchange,
+		"orders",
+		orderV2{Units: []string{"artillery"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishJSON(
+		conn,
+		testExchange,
+		"orders",
+		order{Units: []string{"cavalry"}, Priority: 5},
+		WithHeader(schemaVersionHeader, int32(4)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []order{
+		{[]string{"infantry"}, 1},
+		{[]string{"artillery"}, 1},
+	} {
+		if got := receive(t, received); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	eventually(t, func() bool {
+		letters, err := ListDeadLetters(conn, 10)
+		return err == nil && len(letters) == 1
+	})
+	select {
+	case got := <-received:
+		t.Errorf("handler got %+v from a future version", got)
+	default:
+	}
+}
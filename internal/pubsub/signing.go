@@ -0,0 +1,574 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	signerHeader             = "x-signer"
+	signatureHeader          = "x-signature"
+	signatureAlgorithmHeader = "x-signature-alg"
+)
+
+const (
+	HMACSHA256 = "hmac-sha256"
+	Ed25519    = "ed25519"
+)
+
+var (
+	ErrVerificationFailed = errors.New("pubsub: message verification failed")
+	ErrKeyConflict        = errors.New("pubsub: identity is registered with another key")
+	// ErrUnknownKey is what a KeyResolver returns for an identity that has
+	// no key.
+	ErrUnknownKey = errors.New("pubsub: no key is registered for the identity")
+	// ErrKeyUnavailable means the key of an identity could not be looked
+	// up, so its messages can be neither trusted nor rejected yet.
+	ErrKeyUnavailable = errors.New("pubsub: signing key is unavailable")
+)
+
+// Signer signs outgoing messages on behalf of an identity, such as a
+// player's username.
+type Signer interface {
+	Identity() string
+	Algorithm() string
+	Sign(data []byte) []byte
+}
+
+func NewHMACSigner(identity string, secret []byte) Signer {
+	return hmacSigner{identity: identity, secret: secret}
+}
+
+func NewEd25519Signer(identity string, key ed25519.PrivateKey) Signer {
+	return ed25519Signer{identity: identity, key: key}
+}
+
+type hmacSigner struct {
+	identity string
+	secret   []byte
+}
+
+func (s hmacSigner) Identity() string {
+	return s.identity
+}
+
+func (s hmacSigner) Algorithm() string {
+	return HMACSHA256
+}
+
+func (s hmacSigner) Sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+type ed25519Signer struct {
+	identity string
+	key      ed25519.PrivateKey
+}
+
+func (s ed25519Signer) Identity() string {
+	return s.identity
+}
+
+func (s ed25519Signer) Algorithm() string {
+	return Ed25519
+}
+
+func (s ed25519Signer) Sign(data []byte) []byte {
+	return ed25519.Sign(s.key, data)
+}
+
+// WithSignature signs the message as signer. The signature covers the
+// signer, the routing key, the message ID, the timestamp, the content type
+// and encoding and the body as sent, so a captured message cannot be replayed
+// under a fresh message ID or to another player's routing key. It is
+// applied after every other option, whatever the order they are given in.
+func WithSignature(signer Signer) PublishOption {
+	return func(p *publishOptions) {
+		p.signer = signer
+	}
+}
+
+func sign(msg *amqp.Publishing, key string, signer Signer) error {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[signerHeader] = signer.Identity()
+	msg.Headers[signatureAlgorithmHeader] = signer.Algorithm()
+	msg.Headers[signatureHeader] = base64.StdEncoding.EncodeToString(
+		signer.Sign(signedData(
+			signer.Identity(),
+			key,
+			msg.MessageId,
+			msg.Timestamp,
+			msg.ContentType,
+			msg.ContentEncoding,
+			msg.Body,
+		)),
+	)
+
+	return nil
+}
+
+// signedData is what a signature covers. AMQP timestamps only keep whole
+// seconds, so that is all of it that is signed. The body is signed as it
+// goes over the wire, so a forged message is rejected before anything
+// decompresses it.
+func signedData(
+	identity, key, messageID string,
+	timestamp time.Time,
+	contentType, contentEncoding string,
+	body []byte,
+) []byte {
+	var seconds int64
+	if !timestamp.IsZero() {
+		seconds = timestamp.Unix()
+	}
+
+	var b bytes.Buffer
+	for _, field := range []string{
+		identity,
+		key,
+		messageID,
+		strconv.FormatInt(seconds, 10),
+		contentType,
+		contentEncoding,
+	} {
+		b.WriteString(field)
+		b.WriteByte('\n')
+	}
+	b.Write(body)
+
+	return b.Bytes()
+}
+
+// KeyResolver looks up the public key of an identity the registry does not
+// know yet, usually by asking the key authority. It returns ErrUnknownKey
+// if the identity has no key; any other error is taken to be temporary.
+type KeyResolver func(identity string) (ed25519.PublicKey, error)
+
+// KeyRegistry holds the keys messages are verified against, by signer
+// identity. Messages from identities it has no key for are rejected.
+type KeyRegistry struct {
+	mu      sync.RWMutex
+	keys    map[string]verifyKey
+	resolve KeyResolver
+	file    *os.File
+}
+
+type verifyKey struct {
+	algorithm string
+	secret    []byte
+	public    ed25519.PublicKey
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: map[string]verifyKey{}}
+}
+
+// NewResolvingKeyRegistry returns a registry that asks resolve for the key
+// of every identity it does not know yet and remembers the answer.
+func NewResolvingKeyRegistry(resolve KeyResolver) *KeyRegistry {
+	r := NewKeyRegistry()
+	r.resolve = resolve
+
+	return r
+}
+
+func (r *KeyRegistry) AddHMACKey(identity string, secret []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[identity] = verifyKey{algorithm: HMACSHA256, secret: secret}
+}
+
+func (r *KeyRegistry) AddEd25519Key(identity string, key ed25519.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[identity] = verifyKey{algorithm: Ed25519, public: key}
+}
+
+// PublicKey returns the Ed25519 key registered for identity.
+func (r *KeyRegistry) PublicKey(identity string) (ed25519.PublicKey, error) {
+	key, err := r.lookup(identity)
+	if err != nil {
+		return nil, err
+	}
+	if key.algorithm != Ed25519 {
+		return nil, fmt.Errorf("'%s' does not sign with %s", identity, Ed25519)
+	}
+
+	return key.public, nil
+}
+
+func (r *KeyRegistry) lookup(identity string) (verifyKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[identity]
+	r.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if r.resolve == nil {
+		return verifyKey{}, fmt.Errorf("%w: unknown identity '%s'", ErrVerificationFailed, identity)
+	}
+
+	public, err := r.resolve(identity)
+	if errors.Is(err, ErrUnknownKey) {
+		return verifyKey{}, fmt.Errorf("%w: unknown identity '%s'", ErrVerificationFailed, identity)
+	}
+	if err != nil {
+		return verifyKey{}, fmt.Errorf(
+			"%w: could not look up '%s': %v",
+			ErrKeyUnavailable,
+			identity,
+			err,
+		)
+	}
+	r.AddEd25519Key(identity, public)
+
+	return verifyKey{algorithm: Ed25519, public: public}, nil
+}
+
+// verify checks the signature on d and returns who signed it.
+func (r *KeyRegistry) verify(d amqp.Delivery) (string, error) {
+	identity, _ := d.Headers[signerHeader].(string)
+	algorithm, _ := d.Headers[signatureAlgorithmHeader].(string)
+	encoded, _ := d.Headers[signatureHeader].(string)
+	if identity == "" || encoded == "" {
+		return "", fmt.Errorf("%w: message is not signed", ErrVerificationFailed)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed signature", ErrVerificationFailed)
+	}
+
+	key, err := r.lookup(identity)
+	if err != nil {
+		return "", err
+	}
+	if key.algorithm != algorithm {
+		return "", fmt.Errorf(
+			"%w: '%s' signs with %s, not %s",
+			ErrVerificationFailed,
+			identity,
+			key.algorithm,
+			algorithm,
+		)
+	}
+
+	// Retries and replays republish the message, so the signature is
+	// checked against the routing key it was first published with.
+	_, routingKey := deliveryOrigin(d)
+	data := signedData(
+		identity,
+		routingKey,
+		d.MessageId,
+		d.Timestamp,
+		d.ContentType,
+		d.ContentEncoding,
+		d.Body,
+	)
+
+	var ok bool
+	switch key.algorithm {
+	case HMACSHA256:
+		ok = hmac.Equal(signature, hmacSigner{secret: key.secret}.Sign(data))
+	case Ed25519:
+		ok = ed25519.Verify(key.public, data, signature)
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: bad signature from '%s'", ErrVerificationFailed, identity)
+	}
+
+	return identity, nil
+}
+
+// WithVerification only hands the handler messages with a valid signature
+// from a key in keys. If claimed is not nil it returns the identities a
+// message claims to come from, such as the username in its body or routing
+// key, and every one of them has to be the signer. Messages that fail
+// verification are always dead-lettered. Messages whose key cannot be
+// looked up right now are retried later, or requeued without a retry
+// policy.
+func WithVerification[T any](
+	keys *KeyRegistry,
+	claimed func(Message[T]) []string,
+) TypedSubscribeOption[T] {
+	return func(o *subscribeOptions) {
+		o.keys = keys
+		typedOptionsOf[T](o).claimed = claimed
+	}
+}
+
+// verifying wraps decode so that it also verifies every delivery.
+func verifying[T any](
+	decode func(amqp.Delivery) (T, error),
+	keys *KeyRegistry,
+	claimed func(Message[T]) []string,
+) func(amqp.Delivery) (T, error) {
+	if keys == nil {
+		return decode
+	}
+
+	return func(d amqp.Delivery) (T, error) {
+		var zero T
+		signer, err := keys.verify(d)
+		if err != nil {
+			return zero, err
+		}
+
+		body, err := decode(d)
+		if err != nil || claimed == nil {
+			return body, err
+		}
+
+		for _, identity := range claimed(newMessage(d, body)) {
+			if identity != signer {
+				return zero, fmt.Errorf(
+					"%w: message claims to be from '%s' but is signed by '%s'",
+					ErrVerificationFailed,
+					identity,
+					signer,
+				)
+			}
+		}
+
+		return body, nil
+	}
+}
+
+// KeyRegistration asks the key authority to bind PublicKey to Identity.
+// Proof is signed with the matching private key, so nobody can register a
+// key they do not hold.
+type KeyRegistration struct {
+	Identity  string
+	PublicKey []byte
+	Proof     []byte
+}
+
+func NewKeyRegistration(identity string, key ed25519.PrivateKey) KeyRegistration {
+	public := key.Public().(ed25519.PublicKey)
+
+	return KeyRegistration{
+		Identity:  identity,
+		PublicKey: public,
+		Proof:     ed25519.Sign(key, registrationData(identity, public)),
+	}
+}
+
+func registrationData(identity string, public ed25519.PublicKey) []byte {
+	return append([]byte("peril key registration\n"+identity+"\n"), public...)
+}
+
+// OpenKeyFile opens the key authority's registry at path, which holds one
+// "<identity> <base64 Ed25519 public key>" line per identity. Keys can be
+// provisioned by adding lines to it up front; Register appends the rest.
+// Identities missing from the registry are looked up in the file again,
+// so servers sharing the file see each other's registrations.
+func OpenKeyFile(path string) (*KeyRegistry, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open key file: %v", err)
+	}
+
+	r := NewKeyRegistry()
+	r.file = file
+	for identity, key := range keys {
+		r.keys[identity] = verifyKey{algorithm: Ed25519, public: key}
+	}
+	r.resolve = func(identity string) (ed25519.PublicKey, error) {
+		keys, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := keys[identity]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	}
+
+	return r, nil
+}
+
+// Register binds the key in reg to its identity after checking its proof.
+// Registering the same key again is a no-op, but an identity that already
+// has another key keeps it and ErrKeyConflict is returned.
+func (r *KeyRegistry) Register(reg KeyRegistration) error {
+	if err := checkKeyIdentity(reg.Identity); err != nil {
+		return err
+	}
+	if len(reg.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("malformed public key")
+	}
+	public := ed25519.PublicKey(reg.PublicKey)
+	if !ed25519.Verify(public, registrationData(reg.Identity, public), reg.Proof) {
+		return fmt.Errorf("%w: bad proof for '%s'", ErrVerificationFailed, reg.Identity)
+	}
+
+	existing, err := r.PublicKey(reg.Identity)
+	if errors.Is(err, ErrKeyUnavailable) {
+		return err
+	}
+	if err == nil {
+		if !existing.Equal(public) {
+			return fmt.Errorf("%w: '%s'", ErrKeyConflict, reg.Identity)
+		}
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[reg.Identity]; ok {
+		return fmt.Errorf("%w: '%s'", ErrKeyConflict, reg.Identity)
+	}
+	if r.file != nil {
+		if _, err := fmt.Fprintf(
+			r.file,
+			"%s %s\n",
+			reg.Identity,
+			base64.StdEncoding.EncodeToString(public),
+		); err != nil {
+			return fmt.Errorf("could not write key file: %v", err)
+		}
+	}
+	r.keys[reg.Identity] = verifyKey{algorithm: Ed25519, public: public}
+
+	return nil
+}
+
+// Close closes the key file of a registry opened with OpenKeyFile.
+func (r *KeyRegistry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	return r.file.Close()
+}
+
+func readKeyFile(path string) (map[string]ed25519.PublicKey, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]ed25519.PublicKey{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open key file: %v", err)
+	}
+	defer file.Close()
+
+	keys := map[string]ed25519.PublicKey{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want '<identity> <public key>'", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: malformed public key", path, line)
+		}
+		// The first key for an identity wins, like in Register.
+		if _, ok := keys[fields[0]]; !ok {
+			keys[fields[0]] = ed25519.PublicKey(key)
+		}
+	}
+
+	return keys, scanner.Err()
+}
+
+// LoadEd25519Key loads the signing key for identity from dir, creating it
+// the first time. dir should be private to the user, and a key other users
+// can read is refused, since anyone holding it can sign as identity.
+func LoadEd25519Key(dir, identity string) (ed25519.PrivateKey, error) {
+	if err := checkKeyIdentity(identity); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, identity+".key")
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf(
+				"signing key '%s' is accessible by other users, its mode should be 0600",
+				path,
+			)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read signing key: %v", err)
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("malformed signing key '%s'", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read signing key: %v", err)
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create key directory: %v", err)
+	}
+	if err = os.WriteFile(
+		path,
+		[]byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"),
+		0600,
+	); err != nil {
+		return nil, fmt.Errorf("could not write signing key: %v", err)
+	}
+
+	return private, nil
+}
+
+// checkKeyIdentity keeps identities from escaping the key directory or
+// breaking the key file format.
+func checkKeyIdentity(identity string) error {
+	if identity == "" || identity == "." || identity == ".." ||
+		strings.ContainsAny(identity, "/\\ \t\r\n") ||
+		strings.HasPrefix(identity, "#") {
+		return fmt.Errorf("'%s' cannot be used as a key name", identity)
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// signedDelivery returns what a subscriber receives for body published to
+// key with opts and signed by signer.
+func signedDelivery(
+	t *testing.T,
+	signer Signer,
+	key, body string,
+	opts ...PublishOption,
+) amqp.Delivery {
+	t.Helper()
+
+	msg, err := marshal(
+		JSON,
+		key,
+		body,
+		append([]PublishOption{WithSignature(signer), WithTimestamp(time.Now())}, opts...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp.Truncate(time.Second),
+		RoutingKey:      key,
+		Body:            msg.Body,
+	}
+}
+
+func TestSignatureCoversRoutingKeyAndMessageID(t *testing.T) {
+	key := newTestKey(t)
+	keys := NewKeyRegistry()
+	keys.AddEd25519Key("alice", key.Public().(ed25519.PublicKey))
+
+	d := signedDelivery(t, NewEd25519Signer("alice", key), "moves.alice", "attack")
+	if signer, err := keys.verify(d); err != nil || signer != "alice" {
+		t.Fatalf("verify = %q, %v", signer, err)
+	}
+
+	replayed := d
+	replayed.MessageId = NewMessageID()
+	if _, err := keys.verify(replayed); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("replay under a fresh message ID: got %v, want %v", err, ErrVerificationFailed)
+	}
+
+	redirected := d
+	redirected.RoutingKey = "moves.bob"
+	if _, err := keys.verify(redirected); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("replay to another routing key: got %v, want %v", err, ErrVerificationFailed)
+	}
+
+	late := d
+	late.Timestamp = d.Timestamp.Add(time.Hour)
+	if _, err := keys.verify(late); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("replay with a new timestamp: got %v, want %v", err, ErrVerificationFailed)
+	}
+}
+
+func TestSignatureIsCheckedBeforeDecompressing(t *testing.T) {
+	key := newTestKey(t)
+	keys := NewKeyRegistry()
+	keys.AddEd25519Key("alice", key.Public().(ed25519.PublicKey))
+
+	d := signedDelivery(
+		t,
+		NewEd25519Signer("alice", key),
+		"moves.alice",
+		strings.Repeat("attack ", 1000),
+		WithCompression(Gzip, 0),
+	)
+	if d.ContentEncoding != "gzip" {
+		t.Fatalf("content encoding %q, want gzip", d.ContentEncoding)
+	}
+	if _, err := keys.verify(d); err != nil {
+		t.Fatalf("verify = %v", err)
+	}
+
+	// A body swapped for one that does not even decompress is rejected on
+	// its signature.
+	forged := d
+	forged.Body = []byte("not gzip")
+	if _, err := keys.verify(forged); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("forged body: got %v, want %v", err, ErrVerificationFailed)
+	}
+
+	recoded := d
+	recoded.ContentEncoding = "zstd"
+	if _, err := keys.verify(recoded); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("changed encoding: got %v, want %v", err, ErrVerificationFailed)
+	}
+}
+
+func TestUnknownSignerIsRejected(t *testing.T) {
+	d := signedDelivery(t, NewEd25519Signer("mallory", newTestKey(t)), "moves.mallory", "attack")
+
+	resolved := []string{}
+	keys := NewResolvingKeyRegistry(func(identity string) (ed25519.PublicKey, error) {
+		resolved = append(resolved, identity)
+		return nil, ErrUnknownKey
+	})
+	if _, err := keys.verify(d); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("got %v, want %v", err, ErrVerificationFailed)
+	}
+	if len(resolved) != 1 || resolved[0] != "mallory" {
+		t.Errorf("resolved %v, want [mallory]", resolved)
+	}
+}
+
+func TestUnavailableKeyIsLookedUpAgain(t *testing.T) {
+	key := newTestKey(t)
+	d := signedDelivery(t, NewEd25519Signer("alice", key), "moves.alice", "attack")
+
+	lookups := 0
+	keys := NewResolvingKeyRegistry(func(identity string) (ed25519.PublicKey, error) {
+		lookups++
+		if lookups == 1 {
+			return nil, errors.New("key authority timed out")
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	})
+
+	_, err := keys.verify(d)
+	if !errors.Is(err, ErrKeyUnavailable) || errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("got %v, want %v", err, ErrKeyUnavailable)
+	}
+	if signer, err := keys.verify(d); err != nil || signer != "alice" {
+		t.Errorf("verify after the authority recovered = %q, %v", signer, err)
+	}
+}
+
+func TestUnavailableKeyRequeuesTheMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	key := newTestKey(t)
+	var mu sync.Mutex
+	lookups := 0
+	keys := NewResolvingKeyRegistry(func(identity string) (ed25519.PublicKey, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		lookups++
+		if lookups < 3 {
+			return nil, errors.New("key authority timed out")
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	})
+
+	received := make(chan Message[string], 1)
+	subscribeTestQueue(
+		t,
+		conn,
+		"moves.alice",
+		func(msg Message[string]) AckType {
+			received <- msg
+			return Ack
+		},
+		WithVerification(keys, func(msg Message[string]) []string {
+			return []string{"alice"}
+		}),
+	)
+
+	if err := PublishJSON(
+		conn,
+		testExchange,
+		"moves.alice",
+		"attack",
+		WithSignature(NewEd25519Signer("alice", key)),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, received); msg.Body != "attack" {
+		t.Errorf("got %q", msg.Body)
+	}
+	if letters, err := ListDeadLetters(conn, 10); err != nil || len(letters) != 0 {
+		t.Errorf("dead letters = %v, %v, want none", letters, err)
+	}
+}
+
+func TestKeyFileRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	keys, err := OpenKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := newTestKey(t)
+	if err = keys.Register(NewKeyRegistration("alice", alice)); err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.Register(NewKeyRegistration("alice", alice)); err != nil {
+		t.Errorf("registering the same key again: %v", err)
+	}
+	if err = keys.Register(NewKeyRegistration("alice", newTestKey(t))); !errors.Is(err, ErrKeyConflict) {
+		t.Errorf("registering another key: got %v, want %v", err, ErrKeyConflict)
+	}
+
+	forged := NewKeyRegistration("bob", newTestKey(t))
+	forged.PublicKey = newTestKey(t).Public().(ed25519.PublicKey)
+	if err = keys.Register(forged); !errors.Is(err, ErrVerificationFailed) {
+		t.Errorf("registering a key without holding it: got %v, want %v", err, ErrVerificationFailed)
+	}
+	keys.Close()
+
+	reopened, err := OpenKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	public, err := reopened.PublicKey("alice")
+	if err != nil || !public.Equal(alice.Public()) {
+		t.Errorf("alice's key after reopening = %v, %v", public, err)
+	}
+	if _, err = reopened.PublicKey("bob"); err == nil {
+		t.Error("bob was registered with a forged proof")
+	}
+}
+
+func TestLoadEd25519KeyRefusesSharedKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	key, err := LoadEd25519Key(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := LoadEd25519Key(dir, "alice")
+	if err != nil || !again.Equal(key) {
+		t.Fatalf("reloading the key = %v", err)
+	}
+
+	if err = os.Chmod(filepath.Join(dir, "alice.key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadEd25519Key(dir, "alice"); err == nil {
+		t.Error("loaded a key other users can read")
+	}
+}
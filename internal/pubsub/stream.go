@@ -0,0 +1,89 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const streamOffsetHeader = "x-stream-offset"
+
+// StreamOffset is where a subscription to a stream queue starts reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	StreamFirst = StreamOffset{"first"}
+	StreamLast  = StreamOffset{"last"}
+	StreamNext  = StreamOffset{"next"}
+)
+
+// StreamFromTime starts at the first messages that reached the stream at
+// or after t. RabbitMQ resolves t to the chunk that holds it, so a few
+// older messages can come first.
+func StreamFromTime(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+func StreamFromOffset(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// WithStreamOffset consumes a stream queue starting at offset. After a
+// reconnect the subscription resumes after the last message it settled.
+// Stream messages cannot be requeued or dead-lettered, so every AckType
+// just moves on to the next message.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.stream = &streamCursor{start: offset}
+	}
+}
+
+// StreamOffsetOf returns the offset of a message consumed from a stream.
+func StreamOffsetOf[T any](msg Message[T]) (int64, bool) {
+	return tableInt(msg.Headers, streamOffsetHeader)
+}
+
+type streamCursor struct {
+	start StreamOffset
+
+	mu   sync.Mutex
+	next int64
+	seen bool
+}
+
+func (c *streamCursor) consumeArgs() amqp.Table {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen {
+		return amqp.Table{streamOffsetHeader: c.next}
+	}
+
+	return amqp.Table{streamOffsetHeader: c.start.value}
+}
+
+func (c *streamCursor) advance(d amqp.Delivery) {
+	offset, ok := tableInt(d.Headers, streamOffsetHeader)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.seen || offset >= c.next {
+		c.next = offset + 1
+		c.seen = true
+	}
+}
+
+func (o subscribeOptions) consumeArgs() amqp.Table {
+	if o.stream == nil {
+		return nil
+	}
+
+	return o.stream.consumeArgs()
+}
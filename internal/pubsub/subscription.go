@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Subscription is a handle to a running consumer. Closing it (or
+// cancelling the context it was created with) cancels the consumer on the
+// broker, lets the deliveries already handed to the client finish and be
+// acked or nacked, and then closes the underlying channel.
+type Subscription struct {
+	conn   *Connection
+	tag    string
+	ctx    context.Context
+	cancel context.CancelFunc
+	setup  func(Transport) error
+
+	mu      sync.Mutex
+	ch      Channel
+	closing bool
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+func newSubscription(
+	ctx context.Context,
+	conn *Connection,
+	queueName string,
+) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Subscription{
+		conn:   conn,
+		tag:    queueName + "." + newID(),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// start hands ch and its delivery loop to the subscription. It returns
+// false if the subscription is already shutting down, in which case the
+// caller owns ch.
+func (s *Subscription) start(ch Channel, loop func()) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.ch = ch
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		loop()
+	}()
+
+	return true
+}
+
+func (s *Subscription) watch() {
+	select {
+	case <-s.ctx.Done():
+		s.Close()
+	case <-s.done:
+	}
+}
+
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.conn.unregister(s)
+
+		s.mu.Lock()
+		s.closing = true
+		ch := s.ch
+		s.mu.Unlock()
+
+		if ch != nil {
+			if err := ch.Cancel(s.tag, false); err != nil &&
+				!errors.Is(err, amqp.ErrClosed) {
+				s.closeErr = err
+			}
+		}
+
+		s.wg.Wait()
+
+		if ch != nil {
+			if err := ch.Close(); err != nil &&
+				!errors.Is(err, amqp.ErrClosed) && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
+
+		s.cancel()
+		close(s.done)
+	})
+
+	return s.closeErr
+}
+
+// Wait blocks until the subscription has been closed and every in-flight
+// delivery has been settled.
+func (s *Subscription) Wait() {
+	<-s.done
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionCloseDrainsInFlightDeliveries(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	sub, err := SubscribeMessage(
+		context.Background(),
+		conn,
+		nil,
+		testExchange,
+		"work",
+		"work",
+		DurableQueue,
+		func(msg Message[string]) AckType {
+			started <- msg.Body
+			<-release
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"1", "2"} {
+		if err = PublishJSON(conn, testExchange, "work", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, started)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- sub.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a handler was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err = receive(t, closed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever was handled was acked, and the rest went back to the queue.
+	if got := broker.QueueLength("work"); got+len(started) != 1 {
+		t.Errorf("%d messages left and %d more handled, want 1 in total", got, len(started))
+	}
+}
+
+func TestSubscriptionStopsWhenContextIsCancelled(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan Message[string], 1)
+	sub, err := SubscribeMessage(
+		ctx,
+		conn,
+		nil,
+		testExchange,
+		"work",
+		"work",
+		DurableQueue,
+		func(msg Message[string]) AckType {
+			received <- msg
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	waited := make(chan struct{})
+	go func() {
+		sub.Wait()
+		close(waited)
+	}()
+	receive(t, waited)
+
+	if err = PublishJSON(conn, testExchange, "work", "late"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		return broker.QueueLength("work") == 1
+	})
+	select {
+	case msg := <-received:
+		t.Errorf("got %q after the subscription stopped", msg.Body)
+	default:
+	}
+}
@@ -0,0 +1,383 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology describes the exchanges, queues and bindings an application
+// expects to find on the broker.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+	// Migrations replace queues whose settings changed. A queue cannot be
+	// redeclared with different arguments, so it is declared under a new
+	// name and the old one is emptied into it and deleted.
+	Migrations []QueueMigration
+}
+
+// QueueMigration moves the messages of the queue From into the queue To
+// and deletes From. Bindings are the bindings From had, which are removed
+// first so nothing new is routed to it.
+type QueueMigration struct {
+	From     string
+	To       string
+	Bindings []BindingSpec
+}
+
+type ExchangeSpec struct {
+	Name    string
+	Kind    string
+	Durable bool
+}
+
+type QueueSpec struct {
+	Name string
+	Kind QueueKind
+}
+
+type BindingSpec struct {
+	Exchange string
+	Queue    string
+	Key      string
+}
+
+type TopologyAction string
+
+const (
+	TopologyCreate   TopologyAction = "create"
+	TopologyConflict TopologyAction = "conflict"
+	// TopologyEnsure is reported for bindings between existing queues and
+	// exchanges, which cannot be inspected over AMQP.
+	TopologyEnsure TopologyAction = "ensure"
+	// TopologyMigrate is reported for queues a QueueMigration replaces.
+	TopologyMigrate TopologyAction = "migrate"
+)
+
+// TopologyChange is one difference between a Topology and the broker.
+type TopologyChange struct {
+	Action TopologyAction
+	Kind   string
+	Name   string
+	Detail string
+}
+
+func (c TopologyChange) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+	}
+
+	return fmt.Sprintf("%s %s %s (%s)", c.Action, c.Kind, c.Name, c.Detail)
+}
+
+// TopologyPlan is what ApplyTopology would change on the broker.
+type TopologyPlan []TopologyChange
+
+// Fprint writes the plan to w, one change per line.
+func (p TopologyPlan) Fprint(w io.Writer) error {
+	if len(p) == 0 {
+		_, err := fmt.Fprintln(w, "The topology is up to date.")
+		return err
+	}
+
+	for _, change := range p {
+		if _, err := fmt.Fprintln(w, change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyTopology declares everything in topology, and the dead-letter
+// topology, then runs its migrations. Declaring what already exists with
+// the same settings is a no-op, and a migration whose old queue is gone
+// is skipped, so it is safe to call on every startup.
+func ApplyTopology(conn *Connection, topology Topology) error {
+	if err := withChannel(conn, func(ch Channel) error {
+		return applyTopology(ch, DeadLetterTopology.with(topology))
+	}); err != nil {
+		return err
+	}
+
+	for _, m := range topology.Migrations {
+		if err := migrateQueue(conn, m); err != nil {
+			return fmt.Errorf("could not migrate queue %s to %s: %w", m.From, m.To, err)
+		}
+	}
+
+	return nil
+}
+
+func applyTopology(ch Channel, topology Topology) error {
+	for _, ex := range topology.Exchanges {
+		if err := declareExchange(ch, ex); err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", ex.Name, err)
+		}
+	}
+
+	for _, q := range topology.Queues {
+		if _, err := declareQueue(ch, q.Name, q.Kind); err != nil {
+			return fmt.Errorf("could not declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range topology.Bindings {
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("could not bind %s: %w", bindingName(b), err)
+		}
+	}
+
+	return nil
+}
+
+// PlanTopology reports what ApplyTopology would change on the broker
+// without changing anything. conn should be opened with PlanOnly, or it
+// will already have declared the dead-letter topology.
+func PlanTopology(conn *Connection, topology Topology) (TopologyPlan, error) {
+	topology = DeadLetterTopology.with(topology)
+	changes := TopologyPlan{}
+	missing := map[string]bool{}
+
+	for _, ex := range topology.Exchanges {
+		change, err := planDeclare(
+			conn,
+			"exchange",
+			ex.Name,
+			fmt.Sprintf("%s, durable=%t", ex.Kind, ex.Durable),
+			func(ch Channel) error {
+				return ch.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, false, false, false, nil)
+			},
+			func(ch Channel) error {
+				return declareExchange(ch, ex)
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+			missing["exchange:"+ex.Name] = change.Action == TopologyCreate
+		}
+	}
+
+	for _, q := range topology.Queues {
+		options := q.Kind.queueOptions()
+		args, err := queueArguments(q.Name, options)
+		if err != nil {
+			return nil, fmt.Errorf("queue %s: %w", q.Name, err)
+		}
+		change, err := planDeclare(
+			conn,
+			"queue",
+			q.Name,
+			fmt.Sprintf("durable=%t, args=%v", options.Durable, args),
+			func(ch Channel) error {
+				_, err := ch.QueueDeclarePassive(
+					q.Name,
+					options.Durable,
+					options.AutoDelete,
+					options.Exclusive,
+					false,
+					nil,
+				)
+				return err
+			},
+			func(ch Channel) error {
+				_, err := declareQueue(ch, q.Name, q.Kind)
+				return err
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+			missing["queue:"+q.Name] = change.Action == TopologyCreate
+		}
+	}
+
+	for _, b := range topology.Bindings {
+		change := TopologyChange{
+			Action: TopologyEnsure,
+			Kind:   "binding",
+			Name:   bindingName(b),
+			Detail: "bindings cannot be inspected over AMQP",
+		}
+		if missing["exchange:"+b.Exchange] || missing["queue:"+b.Queue] {
+			change.Action = TopologyCreate
+			change.Detail = ""
+		}
+		changes = append(changes, change)
+	}
+
+	for _, m := range topology.Migrations {
+		n, ok, err := queueMessages(conn, m.From)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		changes = append(changes, TopologyChange{
+			Action: TopologyMigrate,
+			Kind:   "queue",
+			Name:   m.From,
+			Detail: fmt.Sprintf("move %d messages to %s and delete it", n, m.To),
+		})
+	}
+
+	return changes, nil
+}
+
+// migrateQueue unbinds m.From, republishes its messages straight to m.To
+// and deletes it. Each message is acked only once it has been republished,
+// and the delete fails if anything is left, so no message is lost if the
+// migration is interrupted; it picks up again on the next startup.
+func migrateQueue(conn *Connection, m QueueMigration) error {
+	_, ok, err := queueMessages(conn, m.From)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, b := range m.Bindings {
+		if err = ch.QueueUnbind(b.Queue, b.Key, b.Exchange, nil); err != nil {
+			return fmt.Errorf("could not unbind %s: %w", bindingName(b), err)
+		}
+	}
+
+	moved := 0
+	for {
+		d, ok, err := ch.Get(m.From, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if err = ch.PublishWithContext(
+			context.Background(),
+			"",
+			m.To,
+			false,
+			false,
+			republishing(d),
+		); err != nil {
+			return err
+		}
+		if err = d.Ack(false); err != nil {
+			return err
+		}
+		moved++
+	}
+
+	if _, err = ch.QueueDelete(m.From, false, true, false); err != nil {
+		return err
+	}
+	log.Printf("migrated %d messages from queue %s to %s", moved, m.From, m.To)
+
+	return nil
+}
+
+// queueMessages returns how many messages are ready in the queue name, and
+// false if there is no such queue.
+func queueMessages(conn *Connection, name string) (int, bool, error) {
+	var queue amqp.Queue
+	err := withChannel(conn, func(ch Channel) error {
+		var err error
+		queue, err = ch.QueueDeclarePassive(name, false, false, false, false, nil)
+		return err
+	})
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return queue.Messages, true, nil
+}
+
+// planDeclare checks a single exchange or queue. A failed declare closes
+// the channel it was made on, so every step gets a fresh one.
+func planDeclare(
+	conn *Connection,
+	kind, name, detail string,
+	passive func(Channel) error,
+	declare func(Channel) error,
+) (*TopologyChange, error) {
+	err := withChannel(conn, passive)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return &TopologyChange{
+			Action: TopologyCreate,
+			Kind:   kind,
+			Name:   name,
+			Detail: detail,
+		}, nil
+	}
+	if err != nil && !errors.As(err, &amqpErr) {
+		return nil, err
+	}
+
+	// It exists, so declaring it again only fails if the settings differ.
+	if err == nil {
+		err = withChannel(conn, declare)
+	}
+	if errors.As(err, &amqpErr) {
+		return &TopologyChange{
+			Action: TopologyConflict,
+			Kind:   kind,
+			Name:   name,
+			Detail: amqpErr.Reason,
+		}, nil
+	}
+
+	return nil, err
+}
+
+// with returns t followed by other.
+func (t Topology) with(other Topology) Topology {
+	return Topology{
+		Exchanges:  append(slices.Clone(t.Exchanges), other.Exchanges...),
+		Queues:     append(slices.Clone(t.Queues), other.Queues...),
+		Bindings:   append(slices.Clone(t.Bindings), other.Bindings...),
+		Migrations: append(slices.Clone(t.Migrations), other.Migrations...),
+	}
+}
+
+func withChannel(conn *Connection, f func(Channel) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return f(ch)
+}
+
+func declareExchange(ch Channel, ex ExchangeSpec) error {
+	return ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, false, false, false, nil)
+}
+
+func bindingName(b BindingSpec) string {
+	return fmt.Sprintf("%s -[%s]-> %s", b.Exchange, b.Key, b.Queue)
+}
@@ -0,0 +1,221 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var testTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: testExchange, Kind: amqp.ExchangeTopic, Durable: true},
+	},
+	Queues: []QueueSpec{
+		{Name: "logs", Kind: DurableQueue},
+	},
+	Bindings: []BindingSpec{
+		{Exchange: testExchange, Queue: "logs", Key: "logs.*"},
+	},
+}
+
+func planActions(plan TopologyPlan) map[string]TopologyAction {
+	actions := map[string]TopologyAction{}
+	for _, change := range plan {
+		actions[change.Kind+" "+change.Name] = change.Action
+	}
+
+	return actions
+}
+
+func TestPlanOnlyConnectionDeclaresNothing(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := Connect(broker.Dial, PlanOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	plan, err := PlanTopology(conn, testTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := planActions(plan)
+	for _, name := range []string{
+		"exchange " + DeadLetterExchange,
+		"queue " + DeadLetterQueue,
+		"exchange " + testExchange,
+		"queue logs",
+	} {
+		if actions[name] != TopologyCreate {
+			t.Errorf("%s: got %q, want %q", name, actions[name], TopologyCreate)
+		}
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclarePassive(DeadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil)
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Errorf("planning declared %s: %v", DeadLetterExchange, err)
+	}
+}
+
+func TestPlanAfterApplyOnlyEnsuresBindings(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn, err := Connect(broker.Dial, PlanOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err = ApplyTopology(conn, testTopology); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanTopology(conn, testTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range plan {
+		if change.Kind != "binding" || change.Action != TopologyEnsure {
+			t.Errorf("unexpected change after apply: %s", change)
+		}
+	}
+}
+
+func TestPlanReportsConflicts(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ch.QueueDeclare("logs", false, true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	plan, err := PlanTopology(conn, testTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := planActions(plan)["queue logs"]; got != TopologyConflict {
+		t.Errorf("queue logs: got %q, want %q", got, TopologyConflict)
+	}
+
+	var out strings.Builder
+	if err = plan.Fprint(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "conflict queue logs") {
+		t.Errorf("printed plan is missing the conflict:\n%s", out.String())
+	}
+}
+
+func TestDeadLetterQueueDoesNotDeadLetterIntoItself(t *testing.T) {
+	args, err := queueArguments(DeadLetterQueue, DurableQueue.queueOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := args["x-dead-letter-exchange"]; ok {
+		t.Errorf("dead-letter queue declared with %v", args)
+	}
+}
+
+func TestApplyMigratesQueueToNewType(t *testing.T) {
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	if _, _, err := DeclareAndBind(conn, testExchange, "war", "war.*", DurableQueue); err != nil {
+		t.Fatal(err)
+	}
+	for _, player := range []string{"alice", "bob"} {
+		if err := PublishJSON(conn, testExchange, "war."+player, player); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quorum := QueueOptions{Durable: true, Type: QuorumQueue}
+	topology := Topology{
+		Queues: []QueueSpec{
+			{Name: "war.quorum", Kind: quorum},
+		},
+		Bindings: []BindingSpec{
+			{Exchange: testExchange, Queue: "war.quorum", Key: "war.*"},
+		},
+		Migrations: []QueueMigration{
+			{
+				From: "war",
+				To:   "war.quorum",
+				Bindings: []BindingSpec{
+					{Exchange: testExchange, Queue: "war", Key: "war.*"},
+				},
+			},
+		},
+	}
+
+	err := withChannel(conn, func(ch Channel) error {
+		_, err := declareQueue(ch, "war", quorum)
+		return err
+	})
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("redeclaring war as a quorum queue: got %v, want PRECONDITION_FAILED", err)
+	}
+
+	plan, err := PlanTopology(conn, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := planActions(plan)["queue war"]; got != TopologyMigrate {
+		t.Errorf("queue war: got %q, want %q", got, TopologyMigrate)
+	}
+
+	if err = ApplyTopology(conn, topology); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := queueMessages(conn, "war"); err != nil || ok {
+		t.Errorf("war still exists after the migration: %v", err)
+	}
+	if n, _, err := queueMessages(conn, "war.quorum"); err != nil || n != 2 {
+		t.Errorf("war.quorum has %d messages, want 2: %v", n, err)
+	}
+
+	// Running it again finds nothing left to migrate.
+	if err = ApplyTopology(conn, topology); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Message[string], 3)
+	if _, err = SubscribeMessage(
+		context.Background(),
+		conn,
+		nil,
+		testExchange,
+		"war.quorum",
+		"war.*",
+		quorum,
+		func(msg Message[string]) AckType {
+			received <- msg
+			return Ack
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"alice", "bob"} {
+		msg := receive(t, received)
+		if msg.Body != want || msg.RoutingKey != "war."+want {
+			t.Errorf("got %q from %q, want %q from war.%s", msg.Body, msg.RoutingKey, want, want)
+		}
+	}
+}
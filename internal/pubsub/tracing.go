@@ -0,0 +1,348 @@
+package pubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// traceparentHeader carries the W3C trace context of the span that
+// published a message.
+const traceparentHeader = "traceparent"
+
+const (
+	traceparentVersion = "00"
+	sampledFlag        = 0x01
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) MarshalText() ([]byte, error) {
+	if id == (TraceID{}) {
+		return []byte{}, nil
+	}
+
+	return []byte(id.String()), nil
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) MarshalText() ([]byte, error) {
+	if id == (SpanID{}) {
+		return []byte{}, nil
+	}
+
+	return []byte(id.String()), nil
+}
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID `json:"trace_id"`
+	SpanID  SpanID  `json:"span_id"`
+	Flags   byte    `json:"flags"`
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) traceparent() string {
+	return fmt.Sprintf(
+		"%s-%s-%s-%02x",
+		traceparentVersion,
+		sc.TraceID,
+		sc.SpanID,
+		sc.Flags,
+	)
+}
+
+// parseTraceparent parses a version 00 traceparent header. Invalid headers
+// are ignored, as the W3C spec asks, so the message starts a new trace.
+func parseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != traceparentVersion {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	if len(parts[1]) != 2*len(sc.TraceID) ||
+		len(parts[2]) != 2*len(sc.SpanID) ||
+		len(parts[3]) != 2*len(flags) {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, false
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	return sc, true
+}
+
+func headerSpanContext(headers amqp.Table) (SpanContext, bool) {
+	value, ok := headers[traceparentHeader].(string)
+	if !ok {
+		return SpanContext{}, false
+	}
+
+	return parseTraceparent(value)
+}
+
+type SpanKind string
+
+const (
+	SpanKindProducer SpanKind = "producer"
+	SpanKindConsumer SpanKind = "consumer"
+)
+
+// Span is one publish or one handler invocation. Consumer spans are
+// children of the span that published the message, batch handler spans
+// link to the spans of every message in the batch instead.
+type Span struct {
+	Name       string            `json:"name"`
+	Kind       SpanKind          `json:"kind"`
+	Context    SpanContext       `json:"context"`
+	Parent     SpanID            `json:"parent_span_id"`
+	Links      []SpanContext     `json:"links,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// startSpan starts a span that continues parent's trace, or a new trace if
+// parent is not valid.
+func startSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Flags = parent.Flags
+		span.Parent = parent.SpanID
+	} else {
+		randomID(span.Context.TraceID[:])
+		span.Context.Flags = sampledFlag
+	}
+	randomID(span.Context.SpanID[:])
+
+	return span
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// finish ends the span and hands it to the exporter.
+func (s *Span) finish(err error) {
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if exporter := spanExporter(); exporter != nil {
+		exporter.ExportSpan(*s)
+	}
+}
+
+// startProducerSpan starts the span of publishing msg to exchange with key.
+// It is a child of the traceparent already on msg, if any, and msg's
+// headers are replaced by a copy carrying the new span's traceparent.
+func startProducerSpan(exchange, key string, msg *amqp.Publishing) *Span {
+	parent, _ := headerSpanContext(msg.Headers)
+	span := startSpan("publish "+exchange, SpanKindProducer, parent)
+	span.Attributes["exchange"] = exchange
+	span.Attributes["routing_key"] = key
+	if msg.MessageId != "" {
+		span.Attributes["message_id"] = msg.MessageId
+	}
+
+	headers := amqp.Table{}
+	maps.Copy(headers, msg.Headers)
+	headers[traceparentHeader] = span.Context.traceparent()
+	msg.Headers = headers
+
+	return span
+}
+
+// startConsumerSpan starts the span of handling d from queueName as a
+// child of the span that published it.
+func startConsumerSpan(queueName string, d amqp.Delivery) *Span {
+	parent, _ := headerSpanContext(d.Headers)
+	exchange, key := deliveryOrigin(d)
+
+	span := startSpan("consume "+queueName, SpanKindConsumer, parent)
+	span.Attributes["queue"] = queueName
+	span.Attributes["exchange"] = exchange
+	span.Attributes["routing_key"] = key
+	if d.MessageId != "" {
+		span.Attributes["message_id"] = d.MessageId
+	}
+
+	return span
+}
+
+// startBatchSpan starts the span of handling deliveries as one batch. The
+// messages may belong to different traces, so it starts a trace of its own
+// and links to the span that published each of them.
+func startBatchSpan(queueName string, deliveries []amqp.Delivery) *Span {
+	span := startSpan("consume "+queueName, SpanKindConsumer, SpanContext{})
+	span.Attributes["queue"] = queueName
+	span.Attributes["batch_size"] = strconv.Itoa(len(deliveries))
+	for _, d := range deliveries {
+		if link, ok := headerSpanContext(d.Headers); ok {
+			span.Links = append(span.Links, link)
+		}
+	}
+
+	return span
+}
+
+// WithTraceParent makes the publish part of parent's trace, usually the
+// Trace of the message being handled. An invalid parent is ignored and the
+// publish starts a new trace.
+func WithTraceParent(parent SpanContext) PublishOption {
+	return func(p *publishOptions) {
+		setTraceParent(&p.Publishing, parent)
+	}
+}
+
+func setTraceParent(p *amqp.Publishing, parent SpanContext) {
+	if !parent.IsValid() {
+		return
+	}
+	if p.Headers == nil {
+		p.Headers = amqp.Table{}
+	}
+	p.Headers[traceparentHeader] = parent.traceparent()
+}
+
+// SpanExporter receives every finished span. It is the hook for plugging
+// in a real tracer; ExportSpan is called on the publishing or consuming
+// goroutine, so it should not block.
+type SpanExporter interface {
+	ExportSpan(Span)
+}
+
+// SpanExporterFunc adapts a function to a SpanExporter.
+type SpanExporterFunc func(Span)
+
+func (f SpanExporterFunc) ExportSpan(span Span) {
+	f(span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   SpanExporter
+)
+
+// SetSpanExporter sets where finished spans go. Trace context is
+// propagated either way, but spans are dropped while it is nil, which it
+// is by default.
+func SetSpanExporter(e SpanExporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	exporter = e
+}
+
+func spanExporter() SpanExporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return exporter
+}
+
+// JSONSpanExporter writes every span as one line of JSON.
+type JSONSpanExporter struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{enc: json.NewEncoder(w)}
+}
+
+// StdoutSpanExporter writes spans to standard output.
+func StdoutSpanExporter() *JSONSpanExporter {
+	return NewJSONSpanExporter(os.Stdout)
+}
+
+// OpenSpanExporter returns StdoutSpanExporter if output is "stdout", and
+// otherwise appends spans to the file at output.
+func OpenSpanExporter(output string) (*JSONSpanExporter, error) {
+	if output == "stdout" {
+		return StdoutSpanExporter(), nil
+	}
+
+	return OpenSpanFile(output)
+}
+
+// OpenSpanFile appends spans to the file at path, creating it if needed.
+func OpenSpanFile(path string) (*JSONSpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	e := NewJSONSpanExporter(f)
+	e.closer = f
+
+	return e, nil
+}
+
+func (e *JSONSpanExporter) ExportSpan(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.enc.Encode(span); err != nil {
+		log.Printf("could not export span: %s", err)
+	}
+}
+
+func (e *JSONSpanExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closer == nil {
+		return nil
+	}
+
+	return e.closer.Close()
+}
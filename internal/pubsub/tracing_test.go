@@ -0,0 +1,257 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSpans exports spans into the returned function's result for the
+// rest of the test.
+func recordSpans(t *testing.T) func() []Span {
+	t.Helper()
+
+	var mu sync.Mutex
+	var spans []Span
+	SetSpanExporter(SpanExporterFunc(func(span Span) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		spans = append(spans, span)
+	}))
+	t.Cleanup(func() {
+		SetSpanExporter(nil)
+	})
+
+	return func() []Span {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]Span(nil), spans...)
+	}
+}
+
+// findSpan returns the span of publishing or handling a message sent with
+// routing key key.
+func findSpan(spans []Span, kind SpanKind, key string) (Span, bool) {
+	for _, span := range spans {
+		if span.Kind == kind && span.Attributes["routing_key"] == key {
+			return span, true
+		}
+	}
+
+	return Span{}, false
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := parseTraceparent(valid)
+	if !ok {
+		t.Fatalf("could not parse %s", valid)
+	}
+	if got := sc.traceparent(); got != valid {
+		t.Errorf("round trip gave %s", got)
+	}
+
+	for _, value := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		if _, ok := parseTraceparent(value); ok {
+			t.Errorf("parsed invalid traceparent %q", value)
+		}
+	}
+}
+
+// A move that starts a war is one trace: every span is a child of the one
+// before it.
+func TestTraceFollowsMessagesAcrossHandlers(t *testing.T) {
+	spans := recordSpans(t)
+
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	wars := make(chan Message[string], 1)
+	subscribeTestQueue(t, conn, "wars", func(msg Message[string]) AckType {
+		wars <- msg
+		return Ack
+	})
+	subscribeTestQueue(t, conn, "moves", func(msg Message[string]) AckType {
+		if err := PublishJSON(
+			conn,
+			testExchange,
+			"wars",
+			"war over "+msg.Body,
+			WithTraceParent(msg.Trace),
+		); err != nil {
+			t.Error(err)
+		}
+		return Ack
+	})
+
+	if err := PublishJSON(conn, testExchange, "moves", "asia"); err != nil {
+		t.Fatal(err)
+	}
+	war := receive(t, wars)
+
+	steps := []struct {
+		kind SpanKind
+		key  string
+	}{
+		{SpanKindProducer, "moves"},
+		{SpanKindConsumer, "moves"},
+		{SpanKindProducer, "wars"},
+		{SpanKindConsumer, "wars"},
+	}
+	var chain []Span
+	eventually(t, func() bool {
+		chain = nil
+		for _, step := range steps {
+			span, ok := findSpan(spans(), step.kind, step.key)
+			if !ok {
+				return false
+			}
+			chain = append(chain, span)
+		}
+		return true
+	})
+
+	if chain[0].Parent != (SpanID{}) {
+		t.Errorf("the first publish has parent %s", chain[0].Parent)
+	}
+	for i := 1; i < len(chain); i++ {
+		span, parent := chain[i], chain[i-1]
+		if span.Parent != parent.Context.SpanID {
+			t.Errorf(
+				"%s %s has parent %s, want %s %s",
+				steps[i].kind,
+				steps[i].key,
+				span.Parent,
+				steps[i-1].kind,
+				parent.Context.SpanID,
+			)
+		}
+		if span.Context.TraceID != chain[0].Context.TraceID {
+			t.Errorf(
+				"%s %s is in trace %s, want %s",
+				steps[i].kind,
+				steps[i].key,
+				span.Context.TraceID,
+				chain[0].Context.TraceID,
+			)
+		}
+	}
+
+	consumeWar := chain[len(chain)-1]
+	if war.Trace != consumeWar.Context {
+		t.Errorf("handler saw trace %+v, want its span %+v", war.Trace, consumeWar.Context)
+	}
+}
+
+func TestBatchSpanLinksEveryMessage(t *testing.T) {
+	spans := recordSpans(t)
+
+	broker := NewMemoryBroker()
+	conn := newTestConnection(t, broker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	batches := make(chan []Message[string], 1)
+	if _, err := SubscribeBatch(
+		ctx,
+		conn,
+		nil,
+		testExchange,
+		"logs",
+		"logs",
+		TransientQueue,
+		func(msgs []Message[string]) []AckType {
+			batches <- msgs
+			return SettleAll(Ack)
+		},
+		WithBatchSize(2),
+		WithBatchWindow(time.Second),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"a", "b"} {
+		if err := PublishJSON(conn, testExchange, "logs", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs := receive(t, batches); len(msgs) != 2 {
+		t.Fatalf("batch of %d messages, want 2", len(msgs))
+	}
+
+	var batch Span
+	eventually(t, func() bool {
+		for _, span := range spans() {
+			if span.Kind == SpanKindConsumer && span.Attributes["queue"] == "logs" {
+				batch = span
+				return true
+			}
+		}
+		return false
+	})
+
+	published := map[SpanContext]bool{}
+	for _, span := range spans() {
+		if span.Kind == SpanKindProducer {
+			published[span.Context] = true
+		}
+	}
+	if len(batch.Links) != 2 {
+		t.Fatalf("batch span has %d links, want 2", len(batch.Links))
+	}
+	for _, link := range batch.Links {
+		if !published[link] {
+			t.Errorf("batch span links to %+v, which no publish started", link)
+		}
+	}
+}
+
+func TestJSONSpanExporter(t *testing.T) {
+	var out strings.Builder
+	e := NewJSONSpanExporter(&out)
+
+	span := startSpan("publish peril_topic", SpanKindProducer, SpanContext{})
+	span.End = span.Start.Add(time.Millisecond)
+	e.ExportSpan(*span)
+
+	var got struct {
+		Context struct {
+			TraceID string `json:"trace_id"`
+			SpanID  string `json:"span_id"`
+		}
+		Parent string `json:"parent_span_id"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Context.TraceID != span.Context.TraceID.String() ||
+		got.Context.SpanID != span.Context.SpanID.String() {
+		t.Errorf(
+			"exported context %+v, want %s/%s",
+			got.Context,
+			span.Context.TraceID,
+			span.Context.SpanID,
+		)
+	}
+	if got.Parent != "" {
+		t.Errorf("root span exported with parent %q", got.Parent)
+	}
+	if !strings.HasSuffix(out.String(), "}\n") || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("want one line of JSON, got %q", out.String())
+	}
+}
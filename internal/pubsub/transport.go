@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Channel is the part of *amqp.Channel that pubsub relies on. The AMQP
+// transport hands out *amqp.Channel values directly.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Cancel(consumer string, noWait bool) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(ret chan amqp.Return) chan amqp.Return
+	GetNextPublishSeqNo() uint64
+	IsClosed() bool
+	Close() error
+}
+
+// Transport is a single connection to a broker. Deliveries are acked and
+// nacked through their amqp.Acknowledger as usual.
+type Transport interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Dialer opens a new Transport. Connection calls it again every time it
+// has to reconnect.
+type Dialer func() (Transport, error)
+
+func AMQPDialer(url string) Dialer {
+	return func() (Transport, error) {
+		conn, err := amqp.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+
+		return amqpTransport{conn}, nil
+	}
+}
+
+type amqpTransport struct {
+	*amqp.Connection
+}
+
+func (t amqpTransport) Channel() (Channel, error) {
+	ch, err := t.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
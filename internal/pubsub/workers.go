@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultPrefetch = 10
+
+// WithPrefetch sets how many unacknowledged deliveries the broker hands
+// the subscription at once.
+func WithPrefetch(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = count
+	}
+}
+
+// WithConcurrency processes up to workers deliveries in parallel.
+func WithConcurrency(workers int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = workers
+	}
+}
+
+// WithOrderingKey keeps deliveries with the same key on the same worker so
+// they are handled in the order they arrived.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithOrderedRoutingKeys preserves ordering per routing key, for example
+// per player for army_moves.<username>.
+func WithOrderedRoutingKeys() SubscribeOption {
+	return WithOrderingKey(func(d amqp.Delivery) string {
+		return d.RoutingKey
+	})
+}
+
+func (o subscribeOptions) prefetchCount() int {
+	if o.prefetch > 0 {
+		return o.prefetch
+	}
+
+	return max(defaultPrefetch, o.concurrency)
+}
+
+// dispatch hands every delivery to process on one of the subscription's
+// workers and returns once deliveryCh is closed and all of them are done.
+// Without an ordering key the workers share one queue; with one, each
+// worker gets its own queue and a key always hashes to the same worker.
+func dispatch(
+	deliveryCh <-chan amqp.Delivery,
+	options subscribeOptions,
+	process func(amqp.Delivery),
+) {
+	if options.concurrency <= 1 {
+		for delivery := range deliveryCh {
+			process(delivery)
+		}
+		return
+	}
+
+	queueCount := 1
+	if options.orderingKey != nil {
+		queueCount = options.concurrency
+	}
+	queues := make([]chan amqp.Delivery, queueCount)
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < options.concurrency; i++ {
+		wg.Add(1)
+		go func(queue <-chan amqp.Delivery) {
+			defer wg.Done()
+			for delivery := range queue {
+				process(delivery)
+			}
+		}(queues[i%queueCount])
+	}
+
+	for delivery := range deliveryCh {
+		queue := queues[0]
+		if options.orderingKey != nil {
+			h := fnv.New32a()
+			h.Write([]byte(options.orderingKey(delivery)))
+			queue = queues[h.Sum32()%uint32(queueCount)]
+		}
+		queue <- delivery
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package pubsub
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDispatchKeepsOrderPerKey(t *testing.T) {
+	keys := []string{"moves.alice", "moves.bob", "moves.carol"}
+	deliveryCh := make(chan amqp.Delivery)
+	go func() {
+		defer close(deliveryCh)
+		for i := range 50 {
+			for _, key := range keys {
+				deliveryCh <- amqp.Delivery{RoutingKey: key, Body: []byte(strconv.Itoa(i))}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	dispatch(
+		deliveryCh,
+		subscribeOptions{
+			concurrency: 4,
+			orderingKey: func(d amqp.Delivery) string {
+				return d.RoutingKey
+			},
+		},
+		func(d amqp.Delivery) {
+			n, _ := strconv.Atoi(string(d.Body))
+			// Later deliveries finish sooner, which would reorder them if
+			// they shared a key but not a worker.
+			time.Sleep(time.Duration(50-n) * 10 * time.Microsecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			seen[d.RoutingKey] = append(seen[d.RoutingKey], n)
+		},
+	)
+
+	for _, key := range keys {
+		if len(seen[key]) != 50 {
+			t.Fatalf("%s: handled %d deliveries, want 50", key, len(seen[key]))
+		}
+		for i, n := range seen[key] {
+			if n != i {
+				t.Errorf("%s: delivery %d handled in position %d", key, n, i)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatchRunsWorkersConcurrently(t *testing.T) {
+	const workers = 3
+	deliveryCh := make(chan amqp.Delivery, workers)
+	for range workers {
+		deliveryCh <- amqp.Delivery{}
+	}
+	close(deliveryCh)
+
+	// Every delivery waits for all the others to start, so this only
+	// finishes if they are handled in parallel.
+	var started sync.WaitGroup
+	started.Add(workers)
+	done := make(chan struct{})
+	go func() {
+		dispatch(deliveryCh, subscribeOptions{concurrency: workers}, func(amqp.Delivery) {
+			started.Done()
+			started.Wait()
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries were not handled in parallel")
+	}
+}
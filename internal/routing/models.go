@@ -6,6 +6,22 @@ type PlayingState struct {
 	IsPaused bool
 }
 
+type PlayingStateRequest struct {
+	Username string
+}
+
+// KeyRequest asks the server for the public key Username signs with.
+type KeyRequest struct {
+	Username string
+}
+
+// PublicKey is the server's answer to a KeyRequest. Key is empty if
+// Username has no key.
+type PublicKey struct {
+	Username string
+	Key      []byte
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
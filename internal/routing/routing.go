@@ -7,9 +7,18 @@ const (
 
 	PauseKey = "pause"
 
+	PlayingStateKey = "playing_state"
+
 	GameLogSlug = "game_logs"
+
+	KeyRegisterKey = "keys.register"
+
+	KeyLookupKey = "keys.lookup"
 )
 
+// KeysFile is where the server keeps the public key of every player.
+const KeysFile = "peril_public_keys"
+
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
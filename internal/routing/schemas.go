@@ -0,0 +1,24 @@
+package routing
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// Wire versions of the messages defined in this package. Bump a version
+// whenever its type changes shape, and register an upcaster from the old
+// shape so clients still publishing it keep working.
+const (
+	PlayingStateVersion        = 1
+	PlayingStateRequestVersion = 1
+	GameLogVersion             = 1
+	KeyRegistrationVersion     = 1
+	KeyRequestVersion          = 1
+	PublicKeyVersion           = 1
+)
+
+func init() {
+	pubsub.SetSchemaVersion[PlayingState](PlayingStateVersion)
+	pubsub.SetSchemaVersion[PlayingStateRequest](PlayingStateRequestVersion)
+	pubsub.SetSchemaVersion[GameLog](GameLogVersion)
+	pubsub.SetSchemaVersion[pubsub.KeyRegistration](KeyRegistrationVersion)
+	pubsub.SetSchemaVersion[KeyRequest](KeyRequestVersion)
+	pubsub.SetSchemaVersion[PublicKey](PublicKeyVersion)
+}
@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// ControlPriority is the priority the server publishes control messages
+// such as pause and resume with. It only matters on a queue declared with
+// a MaxPriority that also carries other traffic.
+const ControlPriority uint8 = 10
+
+// PauseQueue is each client's transient queue of pause and resume
+// messages. Nothing else is routed to it, so control messages never wait
+// behind game traffic and the queue needs no priorities.
+var PauseQueue = pubsub.QueueOptions{
+	AutoDelete: true,
+	Exclusive:  true,
+}
+
+// WarQueue is shared by every client. It is a quorum queue so a war that
+// keeps being requeued is dead-lettered once it has been requeued
+// WarDeliveryLimit times instead of going round forever. The queue type of
+// an existing queue cannot change, so it is declared as
+// WarRecognitionsQueue and the classic war queue older versions declared
+// is migrated into it.
+var WarQueue = pubsub.QueueOptions{
+	Durable:       true,
+	Type:          pubsub.QuorumQueue,
+	DeliveryLimit: WarDeliveryLimit,
+}
+
+const WarDeliveryLimit = 5
+
+const WarRecognitionsQueue = WarRecognitionsPrefix + ".quorum"
+
+// GameLogStream keeps a week of game logs that can be replayed from any
+// point in time without touching the live game_logs queue.
+var GameLogStream = pubsub.QueueOptions{
+	Durable: true,
+	Type:    pubsub.StreamQueue,
+	MaxAge:  7 * 24 * time.Hour,
+}
+
+const GameLogStreamQueue = GameLogSlug + ".stream"
+
+// Topology is everything the server and clients share on the broker.
+// Per-player queues are declared by the subscriptions that own them.
+var Topology = pubsub.Topology{
+	Exchanges: []pubsub.ExchangeSpec{
+		{Name: ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+		{Name: ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+	},
+	Queues: []pubsub.QueueSpec{
+		{Name: GameLogSlug, Kind: pubsub.DurableQueue},
+		{Name: WarRecognitionsQueue, Kind: WarQueue},
+		{Name: PlayingStateKey, Kind: pubsub.DurableQueue},
+		{Name: KeyRegisterKey, Kind: pubsub.DurableQueue},
+		{Name: KeyLookupKey, Kind: pubsub.DurableQueue},
+		{Name: GameLogStreamQueue, Kind: GameLogStream},
+	},
+	Bindings: []pubsub.BindingSpec{
+		{
+			Exchange: ExchangePerilTopic,
+			Queue:    GameLogSlug,
+			Key:      GameLogSlug + ".*",
+		},
+		{
+			Exchange: ExchangePerilTopic,
+			Queue:    GameLogStreamQueue,
+			Key:      GameLogSlug + ".*",
+		},
+		{
+			Exchange: ExchangePerilTopic,
+			Queue:    WarRecognitionsQueue,
+			Key:      WarRecognitionsPrefix + ".*",
+		},
+		{
+			Exchange: ExchangePerilDirect,
+			Queue:    PlayingStateKey,
+			Key:      PlayingStateKey,
+		},
+		{
+			Exchange: ExchangePerilDirect,
+			Queue:    KeyRegisterKey,
+			Key:      KeyRegisterKey,
+		},
+		{
+			Exchange: ExchangePerilDirect,
+			Queue:    KeyLookupKey,
+			Key:      KeyLookupKey,
+		},
+	},
+	Migrations: []pubsub.QueueMigration{
+		{
+			From: WarRecognitionsPrefix,
+			To:   WarRecognitionsQueue,
+			Bindings: []pubsub.BindingSpec{
+				{
+					Exchange: ExchangePerilTopic,
+					Queue:    WarRecognitionsPrefix,
+					Key:      WarRecognitionsPrefix + ".*",
+				},
+			},
+		},
+	},
+}